@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// loadPasswordHash reads the bcrypt hash used for basic auth from a file
+func loadPasswordHash(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := []byte(strings.TrimSpace(string(data)))
+	if _, err := bcrypt.Cost(hash); err != nil {
+		return nil, fmt.Errorf("%s does not contain a bcrypt hash: %w", file, err)
+	}
+	return hash, nil
+}
+
+// basicAuth wraps a handler to require HTTP basic auth with the given username
+// and a password matching the bcrypt hash
+func basicAuth(next http.Handler, username string, hash []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		// Check the password even for a wrong username so both take as long
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passwordOK := bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gpustat-exporter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
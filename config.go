@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the layout of --config.file. Every setting is optional and
+// maps to the flag noted next to it.
+type fileConfig struct {
+	Web     webFileConfig     `yaml:"web"`
+	Gpustat gpustatFileConfig `yaml:"gpustat"`
+	Scrape  scrapeFileConfig  `yaml:"scrape"`
+	Collect collectFileConfig `yaml:"collect"`
+}
+
+type webFileConfig struct {
+	ListenAddress *string `yaml:"listen-address"` // --web.listen-address
+	TelemetryPath *string `yaml:"telemetry-path"` // --web.telemetry-path
+}
+
+type gpustatFileConfig struct {
+	Path     *string         `yaml:"path"`      // --gpustat.path
+	SSHHosts []sshFileConfig `yaml:"ssh-hosts"` // --gpustat.ssh-hosts
+}
+
+// sshFileConfig is an SSH target with its own scrape interval, which
+// defaults to --scrape.interval
+type sshFileConfig struct {
+	Target   string `yaml:"target"`
+	Interval string `yaml:"interval"`
+}
+
+type scrapeFileConfig struct {
+	Interval *string `yaml:"interval"` // --scrape.interval
+}
+
+type collectFileConfig struct {
+	PowerLimits      *bool `yaml:"power-limits"`       // --power.limits
+	Bar1Memory       *bool `yaml:"bar1-memory"`        // --bar1.memory
+	Clocks           *bool `yaml:"clocks"`             // --clocks.enabled
+	MemoryClockRatio *bool `yaml:"memory-clock-ratio"` // --memory-clock.ratio
+	ThrottleReasons  *bool `yaml:"throttle-reasons"`   // --throttle.reasons
+	Virtualization   *bool `yaml:"virtualization"`     // --virt.enabled
+	ECC              *bool `yaml:"ecc"`                // --collect.ecc
+	PCIe             *bool `yaml:"pcie"`               // --collect.pcie
+	PCIeThroughput   *bool `yaml:"pcie-throughput"`    // --collect.pcie-throughput
+	ProcessType      *bool `yaml:"process-type"`       // --collect.process-type
+}
+
+// flagValues returns the settings present in the file keyed by flag name
+func (c *fileConfig) flagValues() map[string]string {
+	values := make(map[string]string)
+	configValue(values, "web.listen-address", c.Web.ListenAddress)
+	configValue(values, "web.telemetry-path", c.Web.TelemetryPath)
+	configValue(values, "gpustat.path", c.Gpustat.Path)
+	if len(c.Gpustat.SSHHosts) > 0 {
+		entries := make([]string, len(c.Gpustat.SSHHosts))
+		for i, host := range c.Gpustat.SSHHosts {
+			entries[i] = host.Target
+			if host.Interval != "" {
+				entries[i] += "=" + host.Interval
+			}
+		}
+		sshHosts := strings.Join(entries, ",")
+		configValue(values, "gpustat.ssh-hosts", &sshHosts)
+	}
+	configValue(values, "scrape.interval", c.Scrape.Interval)
+	configValue(values, "power.limits", c.Collect.PowerLimits)
+	configValue(values, "bar1.memory", c.Collect.Bar1Memory)
+	configValue(values, "clocks.enabled", c.Collect.Clocks)
+	configValue(values, "memory-clock.ratio", c.Collect.MemoryClockRatio)
+	configValue(values, "throttle.reasons", c.Collect.ThrottleReasons)
+	configValue(values, "virt.enabled", c.Collect.Virtualization)
+	configValue(values, "collect.ecc", c.Collect.ECC)
+	configValue(values, "collect.pcie", c.Collect.PCIe)
+	configValue(values, "collect.pcie-throughput", c.Collect.PCIeThroughput)
+	configValue(values, "collect.process-type", c.Collect.ProcessType)
+	return values
+}
+
+// configValue records a setting if it is present in the file
+func configValue[T any](values map[string]string, name string, value *T) {
+	if value != nil {
+		values[name] = fmt.Sprint(*value)
+	}
+}
+
+// loadConfigFile applies the settings in a YAML config file to the flags that
+// were not given on the command line, so flags override the file. Unknown keys
+// are rejected to catch typos at startup.
+func loadConfigFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var config fileConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	// An empty file leaves every flag at its default
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for name, value := range config.flagValues() {
+		if given[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s in %s: %w", value, name, file, err)
+		}
+	}
+	return nil
+}
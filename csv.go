@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// csvColumns is the column order of --gpustat.format=csv output when it has
+// no header row
+var csvColumns = []string{"index", "name", "temp", "util", "mem_used", "mem_total"}
+
+// parseGPUStatCSV parses CSV output from a gpustat wrapper, one GPU per row.
+// An optional header row maps columns by name; otherwise csvColumns is assumed.
+// CSV output carries no hostname, so the local hostname is used.
+func parseGPUStatCSV(output string) ([]*GPUStatOutput, error) {
+	reader := csv.NewReader(strings.NewReader(output))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine hostname for CSV output: %w", err)
+	}
+	result := &GPUStatOutput{Hostname: hostname}
+
+	var columns map[string]int
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading gpustat CSV output: %w", err)
+		}
+
+		if columns == nil {
+			if columns, err = csvColumnIndex(record); err != nil {
+				return nil, err
+			}
+			if columns != nil {
+				continue
+			}
+			columns = csvDefaultColumnIndex()
+		}
+
+		gpu, err := parseCSVRecord(record, columns)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gpustat CSV row %d: %w", row, err)
+		}
+		result.GPUs = append(result.GPUs, gpu)
+	}
+
+	return []*GPUStatOutput{result}, nil
+}
+
+// csvColumnIndex maps column names to positions if record is a header row,
+// returning nil for a data row
+func csvColumnIndex(record []string) (map[string]int, error) {
+	if len(record) == 0 {
+		return nil, nil
+	}
+	if _, err := strconv.Atoi(strings.TrimSpace(record[0])); err == nil {
+		return nil, nil
+	}
+
+	columns := make(map[string]int, len(record))
+	for i, name := range record {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range csvColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("gpustat CSV header is missing column %q", name)
+		}
+	}
+	return columns, nil
+}
+
+// csvDefaultColumnIndex maps the documented column order to positions
+func csvDefaultColumnIndex() map[string]int {
+	columns := make(map[string]int, len(csvColumns))
+	for i, name := range csvColumns {
+		columns[name] = i
+	}
+	return columns
+}
+
+// parseCSVRecord converts a data row into a GPU
+func parseCSVRecord(record []string, columns map[string]int) (GPUInfo, error) {
+	field := func(name string) (string, error) {
+		i := columns[name]
+		if i >= len(record) {
+			return "", fmt.Errorf("missing column %q", name)
+		}
+		return strings.TrimSpace(record[i]), nil
+	}
+	number := func(name string) (*float64, error) {
+		value, err := field(name)
+		if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", name, value)
+		}
+		return &v, nil
+	}
+
+	var gpu GPUInfo
+	var err error
+	if gpu.Index, err = field("index"); err != nil {
+		return gpu, err
+	}
+	if gpu.Name, err = field("name"); err != nil {
+		return gpu, err
+	}
+	if gpu.Temperature, err = number("temp"); err != nil {
+		return gpu, err
+	}
+	if gpu.Utilization, err = number("util"); err != nil {
+		return gpu, err
+	}
+	if gpu.MemoryUsed, err = number("mem_used"); err != nil {
+		return gpu, err
+	}
+	if gpu.MemoryTotal, err = number("mem_total"); err != nil {
+		return gpu, err
+	}
+	return gpu, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// lastHosts is the parsed gpustat output of the last successful scrape, kept
+// for /debug/gpus when --web.debug is set
+var (
+	lastHostsMu sync.Mutex
+	lastHosts   []*GPUStatOutput
+)
+
+// storeLastHosts records the output of a successful scrape for /debug/gpus
+func storeLastHosts(hosts []*GPUStatOutput) {
+	lastHostsMu.Lock()
+	lastHosts = hosts
+	lastHostsMu.Unlock()
+}
+
+// debugGPUs serves the last successfully parsed gpustat output as JSON, to
+// check the parser without decoding the exposition format
+func debugGPUs(w http.ResponseWriter, r *http.Request) {
+	lastHostsMu.Lock()
+	defer lastHostsMu.Unlock()
+
+	hosts := lastHosts
+	if hosts == nil {
+		hosts = []*GPUStatOutput{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(hosts)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// eccCollector exposes the GPUs' aggregate ECC error totals as counters. The
+// totals are kept in the GPU's infoROM, so unlike the volatile ones they don't
+// reset when the driver reloads, and the values from the last scrape are
+// reported as const metrics rather than incremented here.
+type eccCollector struct {
+	corrected   *prometheus.Desc
+	uncorrected *prometheus.Desc
+
+	mu      sync.Mutex
+	metrics []prometheus.Metric
+}
+
+// newECCCollector creates the collector with the per-GPU labels
+func newECCCollector() *eccCollector {
+	names := gpuLabelNames()
+	return &eccCollector{
+		corrected: prometheus.NewDesc(
+			prometheus.BuildFQName(*metricNamespace, "", "ecc_errors_corrected_total"),
+			"Corrected ECC errors over the GPU's lifetime, from nvidia-smi (requires --collect.ecc)",
+			names, nil,
+		),
+		uncorrected: prometheus.NewDesc(
+			prometheus.BuildFQName(*metricNamespace, "", "ecc_errors_uncorrected_total"),
+			"Uncorrected ECC errors over the GPU's lifetime, from nvidia-smi (requires --collect.ecc)",
+			names, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *eccCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.corrected
+	ch <- c.uncorrected
+}
+
+// Collect implements prometheus.Collector
+func (c *eccCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, metric := range c.metrics {
+		ch <- metric
+	}
+}
+
+// update replaces the counters with the totals merged into the GPUs by this
+// scrape. GPUs without ECC support report [N/A] and are skipped.
+func (c *eccCollector) update(hosts []*GPUStatOutput) {
+	names := gpuLabelNames()
+
+	var metrics []prometheus.Metric
+	for _, stats := range hosts {
+		for _, gpu := range stats.GPUs {
+			labels := gpuLabels(stats.Hostname, gpu)
+			values := make([]string, len(names))
+			for i, name := range names {
+				values[i] = labels[name]
+			}
+
+			if gpu.ECCCorrected != nil {
+				metrics = append(metrics, prometheus.MustNewConstMetric(c.corrected, prometheus.CounterValue, *gpu.ECCCorrected, values...))
+			}
+			if gpu.ECCUncorrected != nil {
+				metrics = append(metrics, prometheus.MustNewConstMetric(c.uncorrected, prometheus.CounterValue, *gpu.ECCUncorrected, values...))
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.metrics = metrics
+	c.mu.Unlock()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// graphiteQueue hands formatted scrapes to the Graphite sender, nil when
+// disabled. It holds a single payload so a slow Graphite never blocks scraping.
+var graphiteQueue chan []byte
+
+// setupGraphite starts the background sender for the Graphite plaintext protocol
+func setupGraphite(address string) {
+	graphiteQueue = make(chan []byte, 1)
+
+	go func() {
+		for payload := range graphiteQueue {
+			if err := sendGraphite(address, payload); err != nil {
+				slog.Error("Error sending metrics to Graphite", "err", err)
+			}
+		}
+	}()
+}
+
+// sendGraphite writes a payload to Graphite over a fresh TCP connection
+func sendGraphite(address string, payload []byte) error {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+	_, err = conn.Write(payload)
+	return err
+}
+
+// graphiteComponent makes a label value safe to use as a Graphite path component
+func graphiteComponent(value string) string {
+	return strings.NewReplacer(".", "_", " ", "_", "/", "_").Replace(value)
+}
+
+// formatGraphite renders the per-GPU metrics as Graphite plaintext lines of the
+// form "gpustat.<host>.<gpu>.<metric> <value> <timestamp>"
+func formatGraphite(gatherer prometheus.Gatherer, now time.Time) ([]byte, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool)
+	for _, name := range gpuLabelNames() {
+		allowed[name] = true
+	}
+
+	var buf bytes.Buffer
+	for _, family := range families {
+		name, ok := strings.CutPrefix(family.GetName(), *metricNamespace+"_")
+		if !ok {
+			continue
+		}
+
+	metrics:
+		for _, metric := range family.GetMetric() {
+			var hostname, gpuIndex string
+			for _, label := range metric.GetLabel() {
+				// Skip series split by more than the GPU, such as per-user memory
+				if !allowed[label.GetName()] {
+					continue metrics
+				}
+				switch label.GetName() {
+				case "hostname":
+					hostname = label.GetValue()
+				case "gpu_index":
+					gpuIndex = label.GetValue()
+				}
+			}
+			if hostname == "" || gpuIndex == "" || metric.GetGauge() == nil {
+				continue
+			}
+
+			fmt.Fprintf(&buf, "%s.%s.%s.%s %g %d\n",
+				*metricNamespace, graphiteComponent(hostname), gpuIndex, name, metric.GetGauge().GetValue(), now.Unix())
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// pushGraphite queues the current metrics for Graphite if enabled, dropping
+// them when the previous send is still in progress
+func pushGraphite() {
+	if graphiteQueue == nil {
+		return
+	}
+
+	payload, err := formatGraphite(prometheus.DefaultGatherer, time.Now())
+	if err != nil {
+		slog.Error("Error formatting metrics for Graphite", "err", err)
+		return
+	}
+
+	select {
+	case graphiteQueue <- payload:
+	default:
+		slog.Warn("Previous Graphite send still in progress, dropping metrics")
+	}
+}
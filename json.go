@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// gpustatJSON mirrors the output of "gpustat --json". Numeric fields are
+// pointers since gpustat reports unsupported values as null.
+type gpustatJSON struct {
+	Hostname      string `json:"hostname"`
+	DriverVersion string `json:"driver_version"`
+	QueryTime     string `json:"query_time"`
+	GPUs          []struct {
+		Index       int      `json:"index"`
+		UUID        string   `json:"uuid"`
+		Name        string   `json:"name"`
+		Temperature *float64 `json:"temperature.gpu"`
+		FanSpeed    *float64 `json:"fan.speed"`
+		Utilization *float64 `json:"utilization.gpu"`
+		PowerDraw   *float64 `json:"power.draw"`
+		MemoryUsed  *float64 `json:"memory.used"`
+		MemoryTotal *float64 `json:"memory.total"`
+		Processes   []struct {
+			Username string   `json:"username"`
+			Command  string   `json:"command"`
+			PID      int      `json:"pid"`
+			Memory   *float64 `json:"gpu_memory_usage"`
+		} `json:"processes"`
+	} `json:"gpus"`
+}
+
+// parseGPUStatJSON parses the output of "gpustat --json"
+func parseGPUStatJSON(output string) ([]*GPUStatOutput, error) {
+	var parsed gpustatJSON
+	if err := json.Unmarshal([]byte(output), &parsed); err != nil {
+		return nil, fmt.Errorf("invalid gpustat JSON output: %w", err)
+	}
+
+	result := &GPUStatOutput{
+		Hostname:      parsed.Hostname,
+		DriverVersion: parsed.DriverVersion,
+	}
+	// gpustat writes the query time in local time without a zone
+	if t, err := time.ParseInLocation("2006-01-02T15:04:05.999999", parsed.QueryTime, time.Local); err == nil {
+		result.Timestamp = t
+	}
+
+	for _, g := range parsed.GPUs {
+		gpu := GPUInfo{
+			Index:       strconv.Itoa(g.Index),
+			Name:        g.Name,
+			UUID:        g.UUID,
+			Temperature: g.Temperature,
+			Utilization: g.Utilization,
+			MemoryUsed:  g.MemoryUsed,
+			MemoryTotal: g.MemoryTotal,
+			FanSpeed:    g.FanSpeed,
+			PowerDraw:   g.PowerDraw,
+		}
+
+		for _, p := range g.Processes {
+			proc := ProcessInfo{
+				Username:      p.Username,
+				Command:       p.Command,
+				PID:           strconv.Itoa(p.PID),
+				MemoryUnknown: p.Memory == nil,
+			}
+			if p.Memory != nil {
+				proc.Memory = *p.Memory
+			}
+			gpu.Processes = append(gpu.Processes, proc)
+		}
+
+		result.GPUs = append(result.GPUs, gpu)
+	}
+
+	return []*GPUStatOutput{result}, nil
+}
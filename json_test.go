@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseGPUStatJSONNullValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  *float64
+	}{
+		{"null", "null", nil},
+		{"zero", "0", floatPtr(0)},
+		{"value", "42", floatPtr(42)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := `{"hostname": "gpu-node-01", "driver_version": "535.104.05", "gpus": [{
+				"index": 0, "name": "NVIDIA A100-SXM4-80GB",
+				"temperature.gpu": ` + tt.value + `, "utilization.gpu": ` + tt.value + `,
+				"memory.used": ` + tt.value + `, "memory.total": ` + tt.value + `,
+				"processes": [{"username": "alice", "command": "python", "pid": 1234, "gpu_memory_usage": ` + tt.value + `}]
+			}]}`
+
+			hosts, err := parseGPUStatJSON(output)
+			if err != nil {
+				t.Fatalf("parseGPUStatJSON() error = %v", err)
+			}
+			gpu := hosts[0].GPUs[0]
+
+			for field, got := range map[string]*float64{
+				"temperature.gpu": gpu.Temperature,
+				"utilization.gpu": gpu.Utilization,
+				"memory.used":     gpu.MemoryUsed,
+				"memory.total":    gpu.MemoryTotal,
+			} {
+				if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+					t.Errorf("%s = %v, want %v", field, formatOptional(got), formatOptional(tt.want))
+				}
+			}
+
+			proc := gpu.Processes[0]
+			if proc.MemoryUnknown != (tt.want == nil) {
+				t.Errorf("process MemoryUnknown = %v, want %v", proc.MemoryUnknown, tt.want == nil)
+			}
+			if tt.want != nil && proc.Memory != *tt.want {
+				t.Errorf("process Memory = %v, want %v", proc.Memory, *tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateGPUMetricsSkipsNullValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		value *float64
+		want  []float64
+	}{
+		{"null", nil, nil},
+		{"zero", floatPtr(0), []float64{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gpuTemperature.Reset()
+			gpuUtilization.Reset()
+			gpuMemoryUsed.Reset()
+			gpuUserMemory.Reset()
+			gpuProcessCount.Reset()
+
+			stats := &GPUStatOutput{Hostname: "json-" + tt.name}
+			gpu := GPUInfo{
+				Index:       "0",
+				Name:        "NVIDIA A100-SXM4-80GB",
+				Temperature: tt.value,
+				Utilization: tt.value,
+				MemoryUsed:  tt.value,
+				MemoryTotal: floatPtr(81920),
+				Processes:   []ProcessInfo{{Username: "alice", MemoryUnknown: tt.value == nil}},
+			}
+			updateGPUMetrics(stats, gpu)
+
+			labels := map[string]string{"hostname": stats.Hostname}
+			for name, vec := range map[string]prometheus.Collector{
+				"temperature": gpuTemperature,
+				"utilization": gpuUtilization,
+				"memory used": gpuMemoryUsed,
+				"user memory": gpuUserMemory,
+			} {
+				if got := seriesValues(t, vec, labels); !equalFloats(got, tt.want) {
+					t.Errorf("%s series = %v, want %v", name, got, tt.want)
+				}
+			}
+			// The process still counts, only its memory is unknown
+			if got := seriesValues(t, gpuProcessCount, labels); !equalFloats(got, []float64{1}) {
+				t.Errorf("process count series = %v, want [1]", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// hostnameRegex derives extra per-GPU labels from the hostname, nil when disabled
+var hostnameRegex *regexp.Regexp
+
+// setupHostnameRegex compiles the hostname regex and checks that its named
+// capture groups are usable label names
+func setupHostnameRegex(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid hostname regex: %w", err)
+	}
+
+	reserved := map[string]bool{
+		"hostname":       true,
+		"gpu_index":      true,
+		"gpu_name":       true,
+		"username":       true,
+		"process_memory": true,
+		"process":        true,
+		"pid":            true,
+		"command":        true,
+		"minor_number":   true,
+		"uuid":           true,
+		"vendor":         true,
+		"namespace":      true,
+		"reason":         true,
+		"team":           true,
+		"type":           true,
+	}
+	seen := make(map[string]bool)
+	for _, name := range re.SubexpNames()[1:] {
+		if name == "" {
+			continue
+		}
+		if name[0] >= '0' && name[0] <= '9' {
+			return fmt.Errorf("capture group %q is not a valid label name", name)
+		}
+		// Prometheus reserves label names starting with "__" for internal use
+		if strings.HasPrefix(name, "__") {
+			return fmt.Errorf("capture group %q is reserved for Prometheus", name)
+		}
+		if reserved[name] || seen[name] {
+			return fmt.Errorf("capture group %q conflicts with another label", name)
+		}
+		seen[name] = true
+	}
+	if len(seen) == 0 {
+		return fmt.Errorf("hostname regex %q has no named capture groups", expr)
+	}
+
+	hostnameRegex = re
+	return nil
+}
+
+// hostnameLabelNames returns the label names defined by the hostname regex
+func hostnameLabelNames() []string {
+	if hostnameRegex == nil {
+		return nil
+	}
+
+	var names []string
+	for _, name := range hostnameRegex.SubexpNames()[1:] {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// addHostnameLabels sets the labels captured from the hostname, leaving them
+// empty when the hostname does not match
+func addHostnameLabels(labels map[string]string, hostname string) {
+	if hostnameRegex == nil {
+		return
+	}
+
+	match := hostnameRegex.FindStringSubmatch(hostname)
+	for i, name := range hostnameRegex.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+		labels[name] = ""
+		if match != nil {
+			labels[name] = match[i]
+		}
+	}
+}
+
+// truncateLabel shortens value to at most max bytes, ending it with "..." so
+// the cut is visible. The cut never splits a UTF-8 character.
+func truncateLabel(value string, max int) string {
+	if max <= 0 || len(value) <= max {
+		return value
+	}
+
+	const marker = "..."
+	cut, suffix := max-len(marker), marker
+	if cut < 0 {
+		cut, suffix = max, ""
+	}
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + suffix
+}
+
+// truncateLabelValues applies --labels.max-length to every parsed field that
+// ends up in a label value, so one malformed line can't produce a label that
+// strict consumers reject
+func truncateLabelValues(stats *GPUStatOutput) {
+	max := *labelMaxLength
+	stats.Hostname = truncateLabel(stats.Hostname, max)
+	stats.DriverVersion = truncateLabel(stats.DriverVersion, max)
+	for i := range stats.GPUs {
+		gpu := &stats.GPUs[i]
+		gpu.Index = truncateLabel(gpu.Index, max)
+		gpu.Name = truncateLabel(gpu.Name, max)
+		gpu.UUID = truncateLabel(gpu.UUID, max)
+		gpu.MinorNumber = truncateLabel(gpu.MinorNumber, max)
+		for j := range gpu.Processes {
+			proc := &gpu.Processes[j]
+			proc.Username = truncateLabel(proc.Username, max)
+			proc.Command = truncateLabel(proc.Command, max)
+			proc.PID = truncateLabel(proc.PID, max)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSetupHostnameRegex(t *testing.T) {
+	t.Cleanup(func() { hostnameRegex = nil })
+
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{`^(?P<rack>r\d+)-(?P<node>n\d+)$`, false},
+		{`^(?P<rack>r\d+)-n(\d+)$`, false},
+		{`^(r\d+)-(n\d+)$`, true},
+		{`^(?P<hostname>.+)$`, true},
+		{`^(?P<rack>r\d+)-(?P<rack>n\d+)$`, true},
+		{`^(?P<rack>r\d+`, true},
+		{`^(?P<__name__>r\d+)-(?P<node>n\d+)$`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			hostnameRegex = nil
+			if err := setupHostnameRegex(tt.expr); (err != nil) != tt.wantErr {
+				t.Errorf("setupHostnameRegex() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGPULabelsMatchNames(t *testing.T) {
+	t.Cleanup(func() { hostnameRegex = nil })
+	if err := setupHostnameRegex(`^(?P<rack>r\d+)-(?P<node>n\d+)$`); err != nil {
+		t.Fatal(err)
+	}
+
+	gpu := GPUInfo{Index: "0", Name: "NVIDIA A100-SXM4-80GB", UUID: "GPU-5d5c3d4e", MinorNumber: "0", Namespace: "4711"}
+	tests := []struct {
+		name  string
+		flags func(t *testing.T)
+	}{
+		{"default", func(t *testing.T) {}},
+		{"slim", func(t *testing.T) { setFlag(t, slimLabels, true) }},
+		{"all", func(t *testing.T) {
+			setFlag(t, uuidLabel, true)
+			setFlag(t, vendorLabel, true)
+			setFlag(t, minorNumberLabel, true)
+			setFlag(t, netns, "4711")
+			setFlag(t, ownershipFile, "ownership.txt")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.flags(t)
+
+			var got []string
+			for name := range gpuLabels("r12-n03", gpu) {
+				got = append(got, name)
+			}
+			want := gpuLabelNames()
+			sort.Strings(got)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("gpuLabels() names = %q, gpuLabelNames() = %q", got, want)
+			}
+		})
+	}
+}
+
+func TestAddHostnameLabels(t *testing.T) {
+	t.Cleanup(func() { hostnameRegex = nil })
+	if err := setupHostnameRegex(`^(?P<rack>r\d+)-(?P<node>n\d+)$`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hostname string
+		want     map[string]string
+	}{
+		{"r12-n03", map[string]string{"rack": "r12", "node": "n03"}},
+		// Labels stay present so every series has the same label names
+		{"login-01", map[string]string{"rack": "", "node": ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			labels := make(map[string]string)
+			addHostnameLabels(labels, tt.hostname)
+			if !reflect.DeepEqual(labels, tt.want) {
+				t.Errorf("addHostnameLabels() = %v, want %v", labels, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateLabel(t *testing.T) {
+	tests := []struct {
+		value string
+		max   int
+		want  string
+	}{
+		{"python", 0, "python"},
+		{"python", 6, "python"},
+		{"python3.11", 8, "pytho..."},
+		{"python", 2, "py"},
+		// Cut before the multi-byte "é" rather than through it
+		{"café-worker", 7, "caf..."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := truncateLabel(tt.value, tt.max); got != tt.want {
+				t.Errorf("truncateLabel(%q, %d) = %q, want %q", tt.value, tt.max, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGPULabelsVendor(t *testing.T) {
+	setFlag(t, vendorLabel, true)
+
+	tests := []struct {
+		backend string
+		want    string
+	}{
+		{"gpustat", "nvidia"},
+		{"rocm-smi", "amd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			setFlag(t, backend, tt.backend)
+			if got := gpuLabels("gpu-node-01", GPUInfo{Index: "0"})["vendor"]; got != tt.want {
+				t.Errorf("vendor = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
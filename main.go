@@ -2,195 +2,1028 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"hash/fnv"
+	"log/slog"
+	"math"
 	"net/http"
+	"os"
 	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
 )
 
 const (
-	namespace = "gpustat"
+	// Username of the bucket aggregating processes beyond the top-N
+	othersUsername = "__others__"
 )
 
+// metricNamespaceRe matches prefixes that keep metric names valid
+var metricNamespaceRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// modelTempLimits are approximate thermal limits in Celsius by GPU model,
+// matched against whole words of the GPU name so "RTX A1000" or "T400" don't
+// pick up the A100 or T4 limit
+var modelTempLimits = []struct {
+	Model string
+	Limit float64
+}{
+	{"H200", 90},
+	{"H100", 90},
+	{"A100", 85},
+	{"V100", 83},
+	{"T4", 85},
+}
+
 var (
-	// Version is set via ldflags during build
-	version = "dev"
+	// Version and revision are set via ldflags during build
+	version  = "dev"
+	revision = "unknown"
 
 	// Command line flags
-	listenAddress  = flag.String("web.listen-address", ":9101", "Address to listen on for web interface and telemetry")
-	metricsPath    = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics")
-	gpustatPath    = flag.String("gpustat.path", "gpustat", "Path to gpustat binary")
-	scrapeInterval = flag.Duration("scrape.interval", 30*time.Second, "Interval between gpustat scrapes")
+	configFile              = flag.String("config.file", "", "YAML file setting the listen address, metrics path, gpustat path, scrape interval and collector toggles; flags given on the command line take precedence (disabled when empty)")
+	metricNamespace         = flag.String("metric.namespace", "gpustat", "Prefix of the exporter's metric names")
+	driverInfoNamespace     = flag.String("metric.driver-info-namespace", "nvidia", "Prefix of the driver_info metric, set separately from --metric.namespace")
+	listenAddress           = flag.String("web.listen-address", ":9101", "Address to listen on for web interface and telemetry (empty disables HTTP, e.g. with --textfile.output)")
+	webDebug                = flag.Bool("web.debug", false, "Serve the last successfully parsed gpustat output as JSON at /debug/gpus")
+	shutdownTimeout         = flag.Duration("web.shutdown-timeout", 10*time.Second, "Time to let in-flight requests finish and buffered trace spans flush on SIGINT/SIGTERM before exiting")
+	metricsPath             = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics")
+	authUsername            = flag.String("web.auth-username", "", "Username required by HTTP basic auth on the metrics path; requires --web.auth-password-file")
+	authPasswordFile        = flag.String("web.auth-password-file", "", "File containing the bcrypt hash of the basic auth password for the metrics path")
+	tlsCertFile             = flag.String("web.tls-cert-file", "", "TLS certificate file; serve HTTPS when set together with --web.tls-key-file, reloaded on SIGHUP")
+	tlsKeyFile              = flag.String("web.tls-key-file", "", "TLS private key file; serve HTTPS when set together with --web.tls-cert-file, reloaded on SIGHUP")
+	gpustatPath             = flag.String("gpustat.path", "gpustat", "Path to gpustat binary")
+	backend                 = flag.String("backend", "gpustat", "Tool to read the GPUs with: gpustat for NVIDIA GPUs or rocm-smi for AMD GPUs")
+	rocmSmiPath             = flag.String("rocm-smi.path", "rocm-smi", "Path to rocm-smi binary, used with --backend=rocm-smi")
+	gpustatFormat           = flag.String("gpustat.format", "table", "Format of the gpustat output: table (gpustat's default) or csv (index,name,temp,util,mem_used,mem_total from a wrapper)")
+	decimalSeparator        = flag.String("parse.decimal-separator", ".", "Decimal separator of numbers in gpustat's table output: . or , for hosts with a comma locale")
+	gpustatJSONOutput       = flag.Bool("gpustat.json", false, "Run gpustat with --json and parse its structured output instead of the text table")
+	scrapeInterval          = flag.Duration("scrape.interval", 30*time.Second, "Interval between gpustat scrapes")
+	scrapeOnDemand          = flag.Bool("scrape.on-demand", false, "Run gpustat on every request to the metrics path instead of on a fixed interval")
+	slowScrapeInterval      = flag.Duration("scrape.slow-interval", 0, "Interval between nvidia-smi queries for rarely changing fields such as power limits (0 queries them with every scrape)")
+	showCmd                 = flag.Bool("gpustat.show-cmd", false, "Run gpustat with --show-cmd and parse process command names")
+	showFanSpeed            = flag.Bool("gpustat.show-fan-speed", false, "Run gpustat with --show-fan-speed and expose fan speed")
+	showPid                 = flag.Bool("gpustat.show-pid", false, "Run gpustat with --show-pid and add a pid label to process memory series")
+	showAll                 = flag.Bool("gpustat.show-all", false, "Run gpustat with --show-all (commands, pids, fan speed, codec and power)")
+	excludeSelf             = flag.Bool("metrics.exclude-self", false, "Drop the exporter's own processes, matched by --metrics.exclude-self-command (requires --gpustat.show-cmd) or by the exporter's pid, parent pid or child pids (requires --gpustat.show-pid)")
+	excludeSelfCommand      = flag.String("metrics.exclude-self-command", "gpustat", "Command name dropped by --metrics.exclude-self, empty to match by pid only")
+	gpustatTimeout          = flag.Duration("gpustat.timeout", 10*time.Second, "Kill gpustat and fail the scrape if it runs longer than this, also applied to each nvidia-smi run (0 disables)")
+	sshHosts                = flag.String("gpustat.ssh-hosts", "", "Comma-separated user@host targets to run gpustat on over SSH instead of locally, each optionally followed by =<interval> to scrape it less often than --scrape.interval (disabled when empty)")
+	perGPUConcurrency       = flag.Int("scrape.per-gpu-concurrency", 1, "Maximum number of GPUs whose metrics are built at the same time on each host (1 builds them one after another)")
+	sshConcurrency          = flag.Int("gpustat.ssh-concurrency", 4, "Maximum number of SSH hosts scraped at the same time")
+	sshKnownHosts           = flag.String("ssh.known-hosts", "", "known_hosts file the host keys of --gpustat.ssh-hosts are verified against; unknown or changed keys fail the host (ssh's default files when empty)")
+	sshAgentSocket          = flag.String("ssh.agent-socket", "", "SSH agent socket used to authenticate to --gpustat.ssh-hosts (the exporter's SSH_AUTH_SOCK when empty)")
+	gpustatInputFile        = flag.String("gpustat.input-file", "", "Read gpustat output from this file on every scrape instead of running gpustat, for testing against saved output")
+	gpustatWaitForBinary    = flag.Duration("gpustat.wait-for-binary", 0, "How long to wait at startup for the gpustat binary to appear (0 fails immediately)")
+	exitIfNoGPUs            = flag.Duration("exit-if-no-gpus", 0, "Exit with an error if no GPUs have been parsed within this grace period after startup (0 disables)")
+	expectedDriver          = flag.String("driver.expected-version", "", "Driver version (or prefix) required before /ready reports ready (disabled when empty)")
+	nvidiaSmiPath           = flag.String("nvidia-smi.path", "nvidia-smi", "Path to nvidia-smi binary")
+	nvidiaSmiRetries        = flag.Int("nvidia-smi.retries", 1, "Number of times to retry a failed nvidia-smi query")
+	nvidiaSmiCacheTTL       = flag.Duration("nvidia-smi.cache-ttl", 0, "Reuse nvidia-smi query results younger than this duration (0 disables caching)")
+	powerLimits             = flag.Bool("power.limits", false, "Query default and enforced power limits from nvidia-smi")
+	bar1Memory              = flag.Bool("bar1.memory", false, "Query BAR1 memory usage from nvidia-smi")
+	clockSpeeds             = flag.Bool("clocks.enabled", false, "Query current graphics and memory clocks from nvidia-smi")
+	memoryClockRatio        = flag.Bool("memory-clock.ratio", false, "Query current and max memory clocks from nvidia-smi and expose their ratio")
+	collectECC              = flag.Bool("collect.ecc", false, "Query lifetime ECC error totals from nvidia-smi and expose them as counters (GPUs without ECC are skipped)")
+	collectPCIe             = flag.Bool("collect.pcie", false, "Query the current PCIe link generation and width from nvidia-smi")
+	collectProcessType      = flag.Bool("collect.process-type", false, "Add a type label (compute or graphics) to process memory series, from nvidia-smi --query-compute-apps; requires pids from --gpustat.show-pid, --gpustat.show-all or --gpustat.json")
+	pcieThroughput          = flag.Bool("collect.pcie-throughput", false, "Sample PCIe RX/TX throughput with nvidia-smi dmon, adding about a second to each scrape")
+	throttleReasons         = flag.Bool("throttle.reasons", false, "Query active clock throttle reasons from nvidia-smi")
+	virtEnabled             = flag.Bool("virt.enabled", false, "Query the virtualization mode from nvidia-smi and expose whether GPUs are passed through to a VM")
+	pushgatewayURL          = flag.String("pushgateway.url", "", "Pushgateway URL to push metrics to after each scrape (disabled when empty)")
+	pushgatewayJob          = flag.String("pushgateway.job", "gpustat", "Job name used when pushing to the Pushgateway")
+	pushgatewayGrouping     = flag.String("pushgateway.grouping", "", "Comma-separated key=value pairs used as the Pushgateway grouping key (default: instance=<hostname>)")
+	textfileOutput          = flag.String("textfile.output", "", "File to atomically write metrics to after each scrape for node_exporter's textfile collector, e.g. /var/lib/node_exporter/textfile/gpustat.prom (disabled when empty)")
+	graphiteAddress         = flag.String("graphite.address", "", "Graphite host:port to send per-GPU metrics to over the plaintext protocol after each scrape (disabled when empty)")
+	slimLabels              = flag.Bool("metrics.slim-labels", false, "Drop gpu_name from numeric per-GPU metrics; use gpustat_gpu_info to join it back")
+	defaultTempLimit        = flag.Float64("temperature.default-limit", 85, "Thermal limit in Celsius for GPU models missing from the built-in table, used for gpustat_temperature_headroom_celsius (0 skips unknown models)")
+	onlyActiveGPUs          = flag.Bool("metrics.only-active-gpus", false, "Skip per-GPU metrics for GPUs with no processes and zero utilization")
+	idleThreshold           = flag.Float64("idle.threshold", 5, "Utilization percent a GPU must exceed to count as busy in gpustat_gpus_busy rather than gpustat_gpus_idle")
+	utilizationBandEdges    = flag.String("metrics.utilization-bands", "0,25,75,100", "Comma-separated upper edges of utilization bands for gpustat_gpus_by_utilization_band (disabled when empty)")
+	hostnameLabelRegex      = flag.String("labels.hostname-regex", "", "Regex whose named capture groups are added as labels on per-GPU metrics (disabled when empty)")
+	labelMaxLength          = flag.Int("labels.max-length", 0, "Truncate label values longer than this many bytes, marking the cut with \"...\" (0 disables)")
+	ownershipFile           = flag.String("ownership.file", "", "File mapping GPU indexes or UUIDs to teams, one <gpu_index or uuid>=<team> per line, added as a team label on per-GPU metrics and reloaded on SIGHUP (disabled when empty)")
+	uuidLabel               = flag.Bool("labels.uuid", false, "Add the GPU UUID as a uuid label on per-GPU metrics, which stays the same when GPU indexes are reshuffled (from gpustat --json, or nvidia-smi for local GPUs)")
+	vendorLabel             = flag.Bool("labels.vendor", false, "Add the GPU vendor from --backend (nvidia or amd) as a vendor label on per-GPU metrics, to tell apart NVIDIA and AMD exporters on a mixed node")
+	minorNumberLabel        = flag.Bool("labels.minor-number", false, "Add the GPU's /dev/nvidiaN minor number as a minor_number label on per-GPU metrics (local Linux only, uses nvidia-smi)")
+	userEMAAlpha            = flag.Float64("metrics.user-ema-alpha", 0, "Smoothing factor (0-1] for the per-user memory moving average; 0 disables gpustat_user_memory_ratio_to_average")
+	slopeWindow             = flag.Duration("metrics.slope-window", 0, "Window of memory samples used for gpustat_memory_used_slope_mb_per_min (0 disables)")
+	topProcessesPerGPU      = flag.Int("metrics.top-processes-per-gpu", 0, "Only emit process memory series for the N largest processes per GPU, summing the rest into username __others__ (0 emits all)")
+	userMemoryBucket        = flag.Float64("metrics.user-memory-bucket-mb", 0, "Round gpustat_user_memory_megabytes down to a multiple of this many megabytes (0 keeps exact values)")
+	processKey              = flag.String("metrics.process-key", "memory", "Label identifying process memory series: memory (process_memory label) or hash (stable process label from username and command)")
+	userRefreshInterval     = flag.Duration("metrics.user-refresh-interval", 0, "Minimum time between changes to a user's set of process memory series; changes in between are coalesced (0 disables)")
+	maintenanceStart        = flag.Bool("maintenance.start-enabled", false, "Start in maintenance mode, serving the last metrics without scraping")
+	logSummaryInterval      = flag.Duration("log.summary-interval", 0, "Replace per-scrape success logs with a summary logged at this interval (0 logs every scrape)")
+	validateEnabled         = flag.Bool("validate.enabled", false, "Sanity check the metrics built by each scrape and log and count violations in gpustat_validation_failures_total")
+	validateMemoryTolerance = flag.Float64("validate.memory-tolerance-mb", 100, "How many megabytes per-user memory may exceed a GPU's used memory before the user_memory check fails")
+	netns                   = flag.String("netns", "", "Comma-separated process IDs or namespace directories such as /proc/<pid>/ns whose network, PID and mount namespaces to also run gpustat in via nsenter, adding a namespace label to per-GPU and per-host metrics (disabled when empty)")
+	logFormat               = flag.String("log.format", "text", "Log format: text or json")
+	logLevel                = flag.String("log.level", "info", "Minimum level of logged messages: debug, info, warn or error")
+	otelTracesEndpoint      = flag.String("otel.traces-endpoint", "", "OTLP/HTTP endpoint URL for scrape traces, e.g. http://localhost:4318 (disabled when empty)")
+
+	// Whether scraping is paused for maintenance
+	maintenanceMode atomic.Bool
+
+	// Whether the last scrape reported the expected driver version
+	driverReady atomic.Bool
+
+	// Whether any scrape has parsed at least one GPU
+	gpusSeen atomic.Bool
 
 	// Track previous metric label sets for cleanup
-	previousUserMemoryLabels    = make(map[string]bool)
-	previousProcessMemoryLabels = make(map[string]bool)
+	previousUserMemoryLabels    = make(trackedSeries)
+	previousProcessMemoryLabels = make(trackedSeries)
+	previousUserTotalLabels     = make(map[hostUser]bool)
+
+	// Scrape results aggregated for the periodic summary log
+	summary scrapeSummary
+
+	// Utilization bands parsed from --metrics.utilization-bands
+	utilizationBands []utilizationBand
+
+	// Process memory series last applied per host and user and when that
+	// set last changed, for --metrics.user-refresh-interval
+	userProcessKeys      = make(map[hostUser]trackedSeries)
+	userProcessRefreshed = make(map[hostUser]time.Time)
+
+	// Exponential moving average of each user's memory, in-memory only
+	userMemoryEMA = make(map[hostUser]float64)
+
+	// Recent memory samples per GPU keyed hostname|namespace|gpu_index,
+	// in-memory only
+	memoryHistoryMu sync.Mutex
+	memoryHistory   = make(map[string][]memorySample)
+
+	// When each GPU's throttle reasons were last sampled, keyed like
+	// memoryHistory, for gpustat_throttle_seconds_total
+	throttleSamplesMu sync.Mutex
+	throttleSamples   = make(map[string]throttleSample)
+
+	// Last nvidia-smi query results shared by all augmentation features, for
+	// the fields queried every scrape and those on the slow interval
+	nvidiaSmiResults     nvidiaSmiCache
+	nvidiaSmiSlowResults nvidiaSmiCache
+
+	// Prometheus metrics, created by initMetrics once flags are parsed
+	gpuTemperature           *prometheus.GaugeVec
+	gpuUtilization           *prometheus.GaugeVec
+	gpuMemoryUsed            *prometheus.GaugeVec
+	gpuMemoryTotal           *prometheus.GaugeVec
+	gpuMemoryUtilization     *prometheus.GaugeVec
+	gpuFanSpeed              *prometheus.GaugeVec
+	gpuTempHeadroom          *prometheus.GaugeVec
+	gpuProcessCount          *prometheus.GaugeVec
+	gpuUserMemory            *prometheus.GaugeVec
+	gpuProcessMemory         *prometheus.GaugeVec
+	gpuMaxProcessMemory      *prometheus.GaugeVec
+	gpuProcessMemoryP50      *prometheus.GaugeVec
+	gpuProcessMemoryP90      *prometheus.GaugeVec
+	gpuTopUserMemory         *prometheus.GaugeVec
+	gpuPowerDefaultLimit     *prometheus.GaugeVec
+	gpuPowerEnforcedLimit    *prometheus.GaugeVec
+	gpuBar1MemoryUsed        *prometheus.GaugeVec
+	gpuBar1MemoryTotal       *prometheus.GaugeVec
+	gpuMemoryClockRatio      *prometheus.GaugeVec
+	gpuClockGraphics         *prometheus.GaugeVec
+	gpuClockMemory           *prometheus.GaugeVec
+	gpuPassthrough           *prometheus.GaugeVec
+	gpuPCIeLinkGen           *prometheus.GaugeVec
+	gpuPCIeLinkWidth         *prometheus.GaugeVec
+	gpuPCIeRx                *prometheus.GaugeVec
+	gpuPCIeTx                *prometheus.GaugeVec
+	gpuThrottleActive        *prometheus.GaugeVec
+	gpuThrottleSeconds       *prometheus.CounterVec
+	gpuInfo                  *prometheus.GaugeVec
+	processCountByCommand    *prometheus.GaugeVec
+	userMemoryRatioToAverage *prometheus.GaugeVec
+	userMemoryTotal          *prometheus.GaugeVec
+	memoryUsedSlope          *prometheus.GaugeVec
+	driverVersion            *prometheus.GaugeVec
+	sampleAge                *prometheus.GaugeVec
+	skippedIdleGPUs          *prometheus.GaugeVec
+	gpusByUtilizationBand    *prometheus.GaugeVec
+	gpusIdle                 *prometheus.GaugeVec
+	multiGPUProcesses        *prometheus.GaugeVec
+	gpusBusy                 *prometheus.GaugeVec
+	zeroValuedFields         *prometheus.CounterVec
+	userMetricThrottled      *prometheus.CounterVec
+	validationFailures       *prometheus.CounterVec
+	scrapeSuccess            prometheus.Gauge
+	consecutiveFailures      prometheus.Gauge
+	lastScrapeTimestamp      prometheus.Gauge
+	scrapesTotal             prometheus.Counter
+	scrapeErrorsTotal        prometheus.Counter
+	nvidiaSmiScrapeSuccess   prometheus.Gauge
+	augmentationSuccess      *prometheus.GaugeVec
+	scrapeDuration           prometheus.Gauge
+	execDuration             *prometheus.GaugeVec
+	parseDuration            prometheus.Gauge
+	outputBytes              *prometheus.GaugeVec
+	maintenanceGauge         prometheus.Gauge
+	workersConfigured        prometheus.Gauge
+	workersActive            prometheus.Gauge
+	hostScrapeSuccess        *prometheus.GaugeVec
+	startTime                prometheus.Gauge
+	buildInfo                *prometheus.GaugeVec
+	commandInfo              *prometheus.GaugeVec
+	eccErrors                *eccCollector
+	driverVersionMatches     prometheus.Gauge
+
+	// Label names for the per-user and per-process series, in stale-key order
+	userMemoryLabelNames    []string
+	processMemoryLabelNames []string
+)
+
+// scrapeSummary aggregates scrape results between summary log lines
+type scrapeSummary struct {
+	mu            sync.Mutex
+	scrapes       int
+	failures      int
+	totalDuration float64
+}
+
+// utilizationBand is an inclusive range of utilization percentages
+type utilizationBand struct {
+	Low  float64
+	High float64
+	Name string
+}
+
+// processSeries is a process memory series waiting to be set
+type processSeries struct {
+	labels prometheus.Labels
+	memory float64
+}
+
+// memorySample is a GPU memory observation used for the slope regression
+type memorySample struct {
+	at     time.Time
+	memory float64
+}
+
+// GPUInfo represents information about a single GPU
+type GPUInfo struct {
+	Index     string
+	Name      string
+	UUID      string
+	Processes []ProcessInfo
+
+	// Core fields, nil when unsupported (null in gpustat's JSON) or unparseable
+	Temperature *float64
+	Utilization *float64
+	MemoryUsed  *float64
+	MemoryTotal *float64
+
+	// Optional fields, nil when not reported by gpustat or nvidia-smi
+	FanSpeed           *float64
+	PowerDraw          *float64
+	PowerDefaultLimit  *float64
+	PowerEnforcedLimit *float64
+	Bar1MemoryUsed     *float64
+	Bar1MemoryTotal    *float64
+	GraphicsClock      *float64
+	MemoryClock        *float64
+	MemoryClockMax     *float64
+	Passthrough        *float64
+	ECCCorrected       *float64
+	ECCUncorrected     *float64
+	PCIeLinkGen        *float64
+	PCIeLinkWidth      *float64
+	PCIeRx             *float64
+	PCIeTx             *float64
+
+	// Whether each known clock throttle reason is active, nil when unknown
+	ThrottleReasons map[string]bool
+
+	// Linux device minor number, empty when unknown
+	MinorNumber string
+
+	// Network namespace gpustat ran in, empty for the exporter's own
+	Namespace string
+}
+
+// ProcessInfo represents a process running on a GPU
+type ProcessInfo struct {
+	Username string
+	Command  string
+	PID      string
+	Memory   float64
+
+	// Set when gpustat reported the process without its memory, which then
+	// stays out of the memory metrics
+	MemoryUnknown bool
+
+	// "compute" or "graphics" from nvidia-smi with --collect.process-type,
+	// empty when unknown
+	ProcessType string
+}
+
+// GPUStatOutput represents the parsed output of gpustat command
+type GPUStatOutput struct {
+	Hostname      string
+	DriverVersion string
+	GPUs          []GPUInfo
+
+	// Sample time from the header, zero when missing or unparseable
+	Timestamp time.Time
+
+	// Namespace gpustat ran in, empty for the exporter's own
+	Namespace string
+
+	// Sections that looked like a field but didn't parse, counted into
+	// gpustat_zero_valued_fields_total by collectMetrics
+	zeroValued []string
+
+	// Whether the output had no header, so Hostname is the local one
+	noHeader bool
+}
+
+// gpuLabelNames returns the label names shared by all per-GPU metrics
+func gpuLabelNames() []string {
+	names := []string{"hostname", "gpu_index", "gpu_name"}
+	if *slimLabels {
+		names = names[:2]
+	}
+	if *uuidLabel {
+		names = append(names, "uuid")
+	}
+	if *vendorLabel {
+		names = append(names, "vendor")
+	}
+	if *minorNumberLabel {
+		names = append(names, "minor_number")
+	}
+	if *netns != "" {
+		names = append(names, "namespace")
+	}
+	if *ownershipFile != "" {
+		names = append(names, "team")
+	}
+	return append(names, hostnameLabelNames()...)
+}
+
+// gpuLabels returns the label values shared by all per-GPU metrics
+func gpuLabels(hostname string, gpu GPUInfo) prometheus.Labels {
+	labels := prometheus.Labels{
+		"hostname":  hostname,
+		"gpu_index": gpu.Index,
+	}
+	if !*slimLabels {
+		labels["gpu_name"] = gpu.Name
+	}
+	if *uuidLabel {
+		labels["uuid"] = gpu.UUID
+	}
+	if *vendorLabel {
+		labels["vendor"] = backendVendor()
+	}
+	if *minorNumberLabel {
+		labels["minor_number"] = gpu.MinorNumber
+	}
+	if *netns != "" {
+		labels["namespace"] = gpu.Namespace
+	}
+	if *ownershipFile != "" {
+		labels["team"] = gpuTeam(gpu)
+	}
+	addHostnameLabels(labels, hostname)
+	return labels
+}
+
+// backendVendor returns the vendor of the GPUs read by --backend
+func backendVendor() string {
+	if *backend == "rocm-smi" {
+		return "amd"
+	}
+	return "nvidia"
+}
+
+// hostUser identifies a user on a host in the per-user state maps. Each
+// --netns namespace is kept apart from the host's own processes.
+type hostUser struct {
+	hostname  string
+	namespace string
+	username  string
+}
+
+// labelValues returns the label values of a per-user series, in the order of
+// hostLabelNames("username")
+func (k hostUser) labelValues() []string {
+	if *netns != "" {
+		return []string{k.hostname, k.namespace, k.username}
+	}
+	return []string{k.hostname, k.username}
+}
+
+// hostLabelNames returns the label names of per-host metrics followed by extra,
+// adding a namespace label with --netns so each namespace's scrape of a host
+// keeps its own series
+func hostLabelNames(extra ...string) []string {
+	names := []string{"hostname"}
+	if *netns != "" {
+		names = append(names, "namespace")
+	}
+	return append(names, extra...)
+}
+
+// hostLabelValues returns the label values of per-host metrics for a host's
+// output followed by extra, in the order of hostLabelNames
+func hostLabelValues(stats *GPUStatOutput, extra ...string) []string {
+	values := []string{stats.Hostname}
+	if *netns != "" {
+		values = append(values, stats.Namespace)
+	}
+	return append(values, extra...)
+}
+
+// seriesKey identifies a label set in a trackedSeries. Each value is quoted
+// before joining, so no label value can make two label sets share a key.
+type seriesKey string
+
+// trackedSeries holds the label values of the series set by a scrape, for
+// deleting those that are not set again by the next one
+type trackedSeries map[seriesKey][]string
+
+// track records a label set in the given name order
+func (t trackedSeries) track(names []string, labels prometheus.Labels) {
+	values := make([]string, len(names))
+	var key strings.Builder
+	for i, name := range names {
+		values[i] = labels[name]
+		key.WriteString(strconv.Quote(values[i]))
+	}
+	t[seriesKey(key.String())] = values
+}
+
+// sameSeries reports whether two tracked label sets are equal
+func sameSeries(a, b trackedSeries) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// labelAttrs turns label values into key/value pairs for structured logging
+func labelAttrs(names, values []string) []any {
+	attrs := make([]any, 0, 2*len(names))
+	for i, name := range names {
+		attrs = append(attrs, name, values[i])
+	}
+	return attrs
+}
+
+// newGPUGaugeVec creates a gauge vector carrying the per-GPU labels plus any extra labels
+func newGPUGaugeVec(name, help string, extraLabels ...string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      name,
+			Help:      help,
+		},
+		append(gpuLabelNames(), extraLabels...),
+	)
+}
 
-	// Prometheus metrics
-	gpuTemperature = prometheus.NewGaugeVec(
+// initMetrics creates the Prometheus metrics. It must be called after
+// flag.Parse since label sets depend on flags.
+func initMetrics() {
+	userMemoryLabelNames = append(gpuLabelNames(), "username")
+	processMemoryLabelNames = append(gpuLabelNames(), processExtraLabels()...)
+
+	gpuTemperature = newGPUGaugeVec("temperature_celsius", "GPU temperature in Celsius")
+	gpuUtilization = newGPUGaugeVec("utilization_percent", "GPU utilization percentage")
+	gpuMemoryUsed = newGPUGaugeVec("memory_used_megabytes", "GPU memory used in megabytes")
+	gpuMemoryTotal = newGPUGaugeVec("memory_total_megabytes", "GPU memory total in megabytes")
+	gpuMemoryUtilization = newGPUGaugeVec("memory_utilization_percent", "GPU memory utilization percentage")
+	gpuTempHeadroom = newGPUGaugeVec("temperature_headroom_celsius", "Degrees Celsius below the GPU model's thermal limit")
+	gpuFanSpeed = newGPUGaugeVec("fan_speed_percent", "GPU fan speed percentage")
+	gpuProcessCount = newGPUGaugeVec("process_count", "Number of processes running on GPU")
+	gpuUserMemory = newGPUGaugeVec("user_memory_megabytes", "Total memory used by user on GPU", "username")
+	gpuProcessMemory = newGPUGaugeVec("process_memory_megabytes", "Memory used by process on GPU", processExtraLabels()...)
+	gpuMaxProcessMemory = newGPUGaugeVec("max_process_memory_megabytes", "Memory used by the largest process on GPU", "username")
+	gpuProcessMemoryP50 = newGPUGaugeVec("process_memory_p50_megabytes", "Median memory used by the processes on GPU")
+	gpuProcessMemoryP90 = newGPUGaugeVec("process_memory_p90_megabytes", "90th percentile of memory used by the processes on GPU")
+	gpuTopUserMemory = newGPUGaugeVec("top_user_memory_megabytes", "Total memory of the user using the most memory on GPU", "username")
+	gpuPowerDefaultLimit = newGPUGaugeVec("power_default_limit_watts", "GPU default power limit in watts")
+	gpuPowerEnforcedLimit = newGPUGaugeVec("power_enforced_limit_watts", "GPU enforced power limit in watts")
+	gpuBar1MemoryUsed = newGPUGaugeVec("bar1_memory_used_megabytes", "GPU BAR1 memory used in megabytes")
+	gpuBar1MemoryTotal = newGPUGaugeVec("bar1_memory_total_megabytes", "GPU BAR1 memory total in megabytes")
+	gpuMemoryClockRatio = newGPUGaugeVec("memory_clock_ratio", "Ratio of current to max GPU memory clock")
+	gpuThrottleActive = newGPUGaugeVec("throttle_active", "Whether a clock throttle reason is active on GPU", "reason")
+	gpuThrottleSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: *metricNamespace,
+			Name:      "throttle_seconds_total",
+			Help:      "Seconds between scrapes during which a clock throttle reason was active on GPU",
+		},
+		append(gpuLabelNames(), "reason"),
+	)
+	gpuClockGraphics = newGPUGaugeVec("clock_graphics_mhz", "Current GPU graphics clock in MHz")
+	gpuClockMemory = newGPUGaugeVec("clock_memory_mhz", "Current GPU memory clock in MHz")
+	gpuPassthrough = newGPUGaugeVec("gpu_passthrough", "Whether the GPU is passed through to a virtual machine")
+	gpuPCIeLinkGen = newGPUGaugeVec("pcie_link_gen", "Current PCIe link generation (requires --collect.pcie)")
+	gpuPCIeLinkWidth = newGPUGaugeVec("pcie_link_width", "Current PCIe link width in lanes (requires --collect.pcie)")
+	gpuPCIeRx = newGPUGaugeVec("pcie_rx_megabytes_per_second", "PCIe receive throughput sampled by nvidia-smi dmon (requires --collect.pcie-throughput)")
+	gpuPCIeTx = newGPUGaugeVec("pcie_tx_megabytes_per_second", "PCIe transmit throughput sampled by nvidia-smi dmon (requires --collect.pcie-throughput)")
+	memoryUsedSlope = newGPUGaugeVec("memory_used_slope_mb_per_min", "Trend of GPU memory used over the slope window in megabytes per minute (requires --metrics.slope-window)")
+
+	gpuInfo = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "temperature_celsius",
-			Help:      "GPU temperature in Celsius",
+			Namespace: *metricNamespace,
+			Name:      "gpu_info",
+			Help:      "GPU information with value 1",
 		},
-		[]string{"hostname", "gpu_index", "gpu_name"},
+		hostLabelNames("gpu_index", "gpu_name", "gpu_uuid", "driver"),
 	)
 
-	gpuUtilization = prometheus.NewGaugeVec(
+	processCountByCommand = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "utilization_percent",
-			Help:      "GPU utilization percentage",
+			Namespace: *metricNamespace,
+			Name:      "process_count_by_command",
+			Help:      "Number of GPU processes by command name (requires --gpustat.show-cmd)",
 		},
-		[]string{"hostname", "gpu_index", "gpu_name"},
+		hostLabelNames("command"),
 	)
 
-	gpuMemoryUsed = prometheus.NewGaugeVec(
+	userMemoryRatioToAverage = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "memory_used_megabytes",
-			Help:      "GPU memory used in megabytes",
+			Namespace: *metricNamespace,
+			Name:      "user_memory_ratio_to_average",
+			Help:      "Ratio of a user's current GPU memory to their moving average (requires --metrics.user-ema-alpha)",
 		},
-		[]string{"hostname", "gpu_index", "gpu_name"},
+		hostLabelNames("username"),
 	)
 
-	gpuMemoryTotal = prometheus.NewGaugeVec(
+	userMemoryTotal = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "memory_total_megabytes",
-			Help:      "GPU memory total in megabytes",
+			Namespace: *metricNamespace,
+			Name:      "user_memory_total_megabytes",
+			Help:      "Memory used by user summed across all GPUs of the host",
 		},
-		[]string{"hostname", "gpu_index", "gpu_name"},
+		hostLabelNames("username"),
 	)
 
-	gpuMemoryUtilization = prometheus.NewGaugeVec(
+	driverVersion = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "memory_utilization_percent",
-			Help:      "GPU memory utilization percentage",
+			Namespace: *driverInfoNamespace,
+			Name:      "driver_info",
+			Help:      "NVIDIA driver version info",
 		},
-		[]string{"hostname", "gpu_index", "gpu_name"},
+		hostLabelNames("version"),
 	)
 
-	gpuProcessCount = prometheus.NewGaugeVec(
+	skippedIdleGPUs = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "process_count",
-			Help:      "Number of processes running on GPU",
+			Namespace: *metricNamespace,
+			Name:      "skipped_idle_gpus",
+			Help:      "Number of idle GPUs whose metrics were skipped (requires --metrics.only-active-gpus)",
 		},
-		[]string{"hostname", "gpu_index", "gpu_name"},
+		hostLabelNames(),
 	)
 
-	gpuUserMemory = prometheus.NewGaugeVec(
+	sampleAge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "user_memory_megabytes",
-			Help:      "Total memory used by user on GPU",
+			Namespace: *metricNamespace,
+			Name:      "sample_age_seconds",
+			Help:      "Age of the gpustat sample according to its header timestamp at scrape time",
 		},
-		[]string{"hostname", "gpu_index", "gpu_name", "username"},
+		hostLabelNames(),
 	)
 
-	gpuProcessMemory = prometheus.NewGaugeVec(
+	gpusByUtilizationBand = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "process_memory_megabytes",
-			Help:      "Memory used by process on GPU",
+			Namespace: *metricNamespace,
+			Name:      "gpus_by_utilization_band",
+			Help:      "Number of GPUs whose utilization falls in each band set by --metrics.utilization-bands",
 		},
-		[]string{"hostname", "gpu_index", "gpu_name", "username", "process_memory"},
+		hostLabelNames("band"),
 	)
 
-	driverVersion = prometheus.NewGaugeVec(
+	gpusIdle = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "nvidia",
-			Name:      "driver_info",
-			Help:      "NVIDIA driver version info",
+			Namespace: *metricNamespace,
+			Name:      "gpus_idle",
+			Help:      "Number of GPUs at or below --idle.threshold utilization",
+		},
+		hostLabelNames(),
+	)
+
+	gpusBusy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "gpus_busy",
+			Help:      "Number of GPUs above --idle.threshold utilization",
+		},
+		hostLabelNames(),
+	)
+
+	multiGPUProcesses = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "multigpu_process_count",
+			Help:      "Number of processes using more than one GPU on the host, such as distributed training ranks (requires pids)",
+		},
+		hostLabelNames(),
+	)
+
+	userMetricThrottled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: *metricNamespace,
+			Name:      "user_metric_throttled_total",
+			Help:      "Number of scrapes in which a user's changed process series were held back (requires --metrics.user-refresh-interval)",
+		},
+		hostLabelNames("username"),
+	)
+
+	zeroValuedFields = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: *metricNamespace,
+			Name:      "zero_valued_fields_total",
+			Help:      "Number of GPU line sections that looked like a field but did not match its pattern, leaving it unset",
+		},
+		[]string{"field"},
+	)
+
+	validationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: *metricNamespace,
+			Name:      "validation_failures_total",
+			Help:      "Number of failed metric sanity checks, by check",
 		},
-		[]string{"hostname", "version"},
+		[]string{"check"},
 	)
 
 	scrapeSuccess = prometheus.NewGauge(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
+			Namespace: *metricNamespace,
 			Name:      "scrape_success",
 			Help:      "Whether the last scrape was successful",
 		},
 	)
 
+	consecutiveFailures = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "consecutive_scrape_failures",
+			Help:      "Number of consecutive failed scrapes, reset to 0 on success",
+		},
+	)
+
+	lastScrapeTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "last_scrape_timestamp_seconds",
+			Help:      "Unix time of the last successful scrape",
+		},
+	)
+
+	scrapesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: *metricNamespace,
+			Name:      "scrape_total",
+			Help:      "Total number of gpustat scrapes attempted",
+		},
+	)
+
+	scrapeErrorsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: *metricNamespace,
+			Name:      "scrape_errors_total",
+			Help:      "Total number of gpustat scrapes that failed to execute or parse",
+		},
+	)
+
+	augmentationSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "augmentation_success",
+			Help:      "Whether the last optional augmentation query succeeded, independent of scrape_success",
+		},
+		[]string{"source"},
+	)
+
+	nvidiaSmiScrapeSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "nvidia_smi_scrape_success",
+			Help:      "Whether the last nvidia-smi augmentation query was successful",
+		},
+	)
+
 	scrapeDuration = prometheus.NewGauge(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
+			Namespace: *metricNamespace,
 			Name:      "scrape_duration_seconds",
 			Help:      "Duration of the last scrape in seconds",
 		},
 	)
-)
 
-// GPUInfo represents information about a single GPU
-type GPUInfo struct {
-	Index       string
-	Name        string
-	Temperature float64
-	Utilization float64
-	MemoryUsed  float64
-	MemoryTotal float64
-	Processes   []ProcessInfo
-}
+	execDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "exec_duration_seconds",
+			Help:      "Time the last gpustat run took to exit, in seconds",
+		},
+		[]string{"host"},
+	)
 
-// ProcessInfo represents a process running on a GPU
-type ProcessInfo struct {
-	Username string
-	Memory   float64
-}
+	parseDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "parse_duration_seconds",
+			Help:      "Time spent parsing the last gpustat output, in seconds",
+		},
+	)
 
-// GPUStatOutput represents the parsed output of gpustat command
-type GPUStatOutput struct {
-	Hostname      string
-	DriverVersion string
-	GPUs          []GPUInfo
+	outputBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "output_bytes",
+			Help:      "Size of the last gpustat output in bytes",
+		},
+		[]string{"host", "namespace"},
+	)
+
+	workersConfigured = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "scrape_workers_configured",
+			Help:      "Maximum number of SSH hosts scraped at the same time",
+		},
+	)
+
+	workersActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "scrape_workers_active",
+			Help:      "Number of SSH hosts currently being scraped",
+		},
+	)
+
+	hostScrapeSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "host_scrape_success",
+			Help:      "Whether the last run of gpustat on an SSH host succeeded",
+		},
+		[]string{"host"},
+	)
+
+	maintenanceGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "maintenance_mode",
+			Help:      "Whether the exporter is in maintenance mode and serving frozen metrics",
+		},
+	)
+
+	startTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "exporter_start_time_seconds",
+			Help:      "Start time of the exporter since unix epoch in seconds",
+		},
+	)
+
+	buildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "exporter_build_info",
+			Help:      "A metric with a constant '1' value labeled by version, goversion and revision from which the exporter was built",
+		},
+		[]string{"version", "goversion", "revision"},
+	)
+
+	commandInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "exporter_command_info",
+			Help:      "A metric with a constant '1' value labeled by each command line the exporter runs gpustat with",
+		},
+		[]string{"command"},
+	)
+
+	driverVersionMatches = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: *metricNamespace,
+			Name:      "driver_version_matches_expected",
+			Help:      "Whether the reported driver version matches --driver.expected-version",
+		},
+	)
+
+	eccErrors = newECCCollector()
 }
 
-func init() {
-	// Register metrics with Prometheus
+// registerMetrics registers the metrics created by initMetrics that the
+// flags enable
+func registerMetrics() {
 	prometheus.MustRegister(gpuTemperature)
 	prometheus.MustRegister(gpuUtilization)
 	prometheus.MustRegister(gpuMemoryUsed)
 	prometheus.MustRegister(gpuMemoryTotal)
 	prometheus.MustRegister(gpuMemoryUtilization)
+	prometheus.MustRegister(gpuFanSpeed)
+	prometheus.MustRegister(gpuTempHeadroom)
 	prometheus.MustRegister(gpuProcessCount)
 	prometheus.MustRegister(gpuUserMemory)
 	prometheus.MustRegister(gpuProcessMemory)
+	prometheus.MustRegister(gpuMaxProcessMemory)
+	prometheus.MustRegister(gpuProcessMemoryP50)
+	prometheus.MustRegister(gpuProcessMemoryP90)
+	prometheus.MustRegister(gpuTopUserMemory)
+	prometheus.MustRegister(gpuPowerDefaultLimit)
+	prometheus.MustRegister(gpuPowerEnforcedLimit)
+	prometheus.MustRegister(gpuBar1MemoryUsed)
+	prometheus.MustRegister(gpuBar1MemoryTotal)
+	prometheus.MustRegister(gpuMemoryClockRatio)
+	prometheus.MustRegister(gpuClockGraphics)
+	prometheus.MustRegister(gpuClockMemory)
+	prometheus.MustRegister(gpuPassthrough)
+	prometheus.MustRegister(gpuPCIeLinkGen)
+	prometheus.MustRegister(gpuPCIeLinkWidth)
+	prometheus.MustRegister(gpuPCIeRx)
+	prometheus.MustRegister(gpuPCIeTx)
+	prometheus.MustRegister(gpuThrottleActive)
+	prometheus.MustRegister(gpuThrottleSeconds)
+	prometheus.MustRegister(gpuInfo)
+	prometheus.MustRegister(processCountByCommand)
+	prometheus.MustRegister(userMemoryRatioToAverage)
+	prometheus.MustRegister(userMemoryTotal)
+	prometheus.MustRegister(memoryUsedSlope)
 	prometheus.MustRegister(driverVersion)
+	prometheus.MustRegister(sampleAge)
+	if *onlyActiveGPUs {
+		prometheus.MustRegister(skippedIdleGPUs)
+	}
+	if len(utilizationBands) > 0 {
+		prometheus.MustRegister(gpusByUtilizationBand)
+	}
+	prometheus.MustRegister(gpusIdle)
+	prometheus.MustRegister(gpusBusy)
+	if pidLabelEnabled() {
+		prometheus.MustRegister(multiGPUProcesses)
+	}
+	prometheus.MustRegister(zeroValuedFields)
+	if *userRefreshInterval > 0 {
+		prometheus.MustRegister(userMetricThrottled)
+	}
+	if *sshHosts != "" {
+		prometheus.MustRegister(workersConfigured)
+		prometheus.MustRegister(workersActive)
+		prometheus.MustRegister(hostScrapeSuccess)
+		workersConfigured.Set(float64(*sshConcurrency))
+	}
+	if *validateEnabled {
+		prometheus.MustRegister(validationFailures)
+		for _, check := range validationChecks {
+			validationFailures.WithLabelValues(check)
+		}
+	}
 	prometheus.MustRegister(scrapeSuccess)
+	prometheus.MustRegister(consecutiveFailures)
+	prometheus.MustRegister(lastScrapeTimestamp)
+	prometheus.MustRegister(scrapesTotal)
+	prometheus.MustRegister(scrapeErrorsTotal)
 	prometheus.MustRegister(scrapeDuration)
+	prometheus.MustRegister(execDuration)
+	prometheus.MustRegister(parseDuration)
+	prometheus.MustRegister(outputBytes)
+	prometheus.MustRegister(maintenanceGauge)
+	prometheus.MustRegister(startTime)
+	prometheus.MustRegister(buildInfo)
+	prometheus.MustRegister(commandInfo)
+	if *expectedDriver != "" {
+		prometheus.MustRegister(driverVersionMatches)
+	}
+	if nvidiaSmiEnabled() {
+		prometheus.MustRegister(nvidiaSmiScrapeSuccess)
+		prometheus.MustRegister(augmentationSuccess)
+	}
+	if *collectECC {
+		prometheus.MustRegister(eccErrors)
+	}
 }
 
-// parseGPUStatOutput parses the output of gpustat command
-func parseGPUStatOutput(output string) (*GPUStatOutput, error) {
-	result := &GPUStatOutput{}
+// Patterns used by the gpustat parser, compiled once rather than per line
+var (
+	// Additional header lines mid-stream
+	// Format: "hostname  Wed Oct 15 12:00:00 2025  535.104.05"
+	headerRe = regexp.MustCompile(`^\S+\s+.*\d{1,2}:\d{2}:\d{2}.*\s\d+\.\d+(?:\.\d+)*$`)
+
+	// Warnings printed by WSL before the command output, e.g.
+	// "wsl: Failed to translate 'C:\...'" or "<3>WSL (123) ERROR: ..."
+	wslBannerRe = regexp.MustCompile(`^(?:<\d+>)?(?i:wsl)\b`)
+
+	// GPU index prefix
+	// Format: "[0]"
+	gpuIndexRe = regexp.MustCompile(`^\[(\d+)\]`)
+
+	// Temperature, optional fan speed, and utilization
+	// Format: "49°C,   0 %", "49'C,   0 %" or with fan "49°C,  30 %,   0 %",
+	// and from some gpustat builds Fahrenheit such as "120°F,   0 %"
+	// The degree marker may also be "℃", "º", "˚", "ᵒ", a mis-decoded "Â°", or a
+	// stray non-UTF-8 byte (e.g. Latin-1 0xB0), which the regexp sees as U+FFFD.
+	// The fan value is captured loosely so an unreadable fan ("?? %") doesn't
+	// lose the temperature and utilization. Values may have a decimal part with
+	// either separator, e.g. "48,5°C" on hosts with a comma locale.
+	tempUtilRe = regexp.MustCompile(`(\d+(?:[.,]\d+)?)\s*(℃|℉|Â?[°º˚ᵒ'\x{FFFD}][CF])(?:,\s*([^,%]*?(?:,\d+)?)\s*%)?,\s*(\d+(?:[.,]\d+)?)\s*%`)
+
+	// Encoder/decoder utilization shown by --show-codec, stripped before matching
+	// Format: "(E:   0 %  D:   0 %)"
+	codecRe = regexp.MustCompile(`\(E:[^)]*\)`)
+
+	// Power draw and enforced limit
+	// Format: "  65 / 300 W"
+	powerRe = regexp.MustCompile(`(\d+(?:[.,]\d+)?)\s*/\s*\d+(?:[.,]\d+)?\s*W\b`)
+
+	// Memory usage, in MB or, from some gpustat/nvidia-smi configurations and
+	// non-NVIDIA backends, GiB or GB
+	// Format: "  1871 / 97887 MB", "1.8 / 80 GiB"
+	memRe = regexp.MustCompile(`(\d+(?:[.,]\d+)?)\s*/\s*(\d+(?:[.,]\d+)?)\s*(MB|MiB|GiB|GB)\b`)
+
+	// Processes section
+	// Format: "username(1224M)"
+	processSectionRe = regexp.MustCompile(`\(\d+M\)`)
+
+	// Single process: username(memoryM), username:command(memoryM), and
+	// with --show-pid (part of --show-all) username/pid(memoryM) or
+	// username:command/pid(memoryM). The command is matched lazily up to the
+	// memory so names with dots, slashes or spaces ("python3.11",
+	// "/usr/bin/python", "Web Content") are kept whole.
+	processRe = regexp.MustCompile(`([^\s:/(]+)(?::(.*?))?(?:/(\d+))?\((\d+)M\)`)
+)
+
+// parseGPUStatOutput parses the output of gpustat command. Output
+// concatenated from several hosts is split into one result per header line.
+func parseGPUStatOutput(output string) ([]*GPUStatOutput, error) {
+	var results []*GPUStatOutput
+	var result *GPUStatOutput
 	scanner := bufio.NewScanner(strings.NewReader(output))
 
 	lineNum := 0
 	for scanner.Scan() {
-		line := scanner.Text()
+		// bufio only drops a CR directly before LF; Windows console pipes can
+		// leave doubled "\r\r\n" endings behind
+		line := strings.TrimRight(scanner.Text(), "\r")
 		lineNum++
 
-		if lineNum == 1 {
-			// First line: hostname and driver version
+		if result == nil {
+			// Windows tools may prefix their output with a byte order mark
+			line = strings.TrimPrefix(line, "\ufeff")
+			if strings.TrimSpace(line) == "" || wslBannerRe.MatchString(line) {
+				continue
+			}
+		}
+
+		// Output from "gpustat --no-header" starts directly with a GPU line,
+		// so fall back to the local hostname
+		if result == nil && strings.HasPrefix(line, "[") {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("gpustat output has no header and the hostname is unknown: %w", err)
+			}
+			result = &GPUStatOutput{Hostname: hostname, noHeader: true}
+			results = append(results, result)
+		} else if result == nil || headerRe.MatchString(strings.TrimSpace(line)) {
+			// Header line: hostname and driver version
 			// Format: "hostname    date    driver_version"
+			result = &GPUStatOutput{}
+			results = append(results, result)
+
 			parts := strings.Fields(line)
 			if len(parts) >= 1 {
 				result.Hostname = parts[0]
 			}
 			if len(parts) >= 5 {
 				result.DriverVersion = parts[len(parts)-1]
+				result.Timestamp = parseHeaderTime(parts[1 : len(parts)-1])
 			}
 			continue
 		}
@@ -200,9 +1033,10 @@ func parseGPUStatOutput(output string) (*GPUStatOutput, error) {
 			continue
 		}
 
-		gpu, err := parseGPULine(line)
+		gpu, zeroValued, err := parseGPULine(line)
+		result.zeroValued = append(result.zeroValued, zeroValued...)
 		if err != nil {
-			log.Printf("Warning: failed to parse GPU line %d: %v", lineNum, err)
+			slog.Warn("Failed to parse GPU line", "line", lineNum, "gpu_index", gpu.Index, "err", err)
 			continue
 		}
 
@@ -213,86 +1047,163 @@ func parseGPUStatOutput(output string) (*GPUStatOutput, error) {
 		return nil, fmt.Errorf("error reading gpustat output: %w", err)
 	}
 
-	return result, nil
+	return results, nil
+}
+
+// parseHeaderTime parses the header date fields, e.g. "Wed Oct 15 12:00:00 2025",
+// in local time as written by gpustat. It returns the zero time for other
+// formats such as non-English locales.
+func parseHeaderTime(fields []string) time.Time {
+	t, err := time.ParseInLocation("Mon Jan 2 15:04:05 2006", strings.Join(fields, " "), time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
 }
 
-// parseGPULine parses a single GPU line from gpustat output
-func parseGPULine(line string) (GPUInfo, error) {
+// parseGPULine parses a single GPU line from gpustat output. The line is
+// split on "|" and every section after the name is classified by the patterns
+// it matches rather than by position, so optional columns (fan, power, codec)
+// may appear in any order. It also returns the fields whose section looked
+// like the field but didn't match its pattern.
+func parseGPULine(line string) (GPUInfo, []string, error) {
 	gpu := GPUInfo{}
+	var zeroValued []string
 
 	// Extract GPU index [N]
-	indexRe := regexp.MustCompile(`^\[(\d+)\]`)
-	if match := indexRe.FindStringSubmatch(line); len(match) > 1 {
+	if match := gpuIndexRe.FindStringSubmatch(line); len(match) > 1 {
 		gpu.Index = match[1]
 	}
 
 	// Split by | to get different sections
 	parts := strings.Split(line, "|")
-	if len(parts) < 3 {
-		return gpu, fmt.Errorf("invalid GPU line format")
+	if len(parts) < 2 {
+		return gpu, nil, fmt.Errorf("invalid GPU line format")
 	}
 
 	// Part 0: GPU name
 	namePart := strings.TrimSpace(parts[0])
 	// Remove the [N] prefix
-	namePart = indexRe.ReplaceAllString(namePart, "")
+	namePart = gpuIndexRe.ReplaceAllString(namePart, "")
 	gpu.Name = strings.TrimSpace(namePart)
 
-	// Part 1: Temperature and Utilization
-	// Format: "49°C,   0 %" or "49'C,   0 %"
-	tempUtilPart := strings.TrimSpace(parts[1])
-	tempUtilRe := regexp.MustCompile(`(\d+)[°']C,\s*(\d+)\s*%`)
-	if match := tempUtilRe.FindStringSubmatch(tempUtilPart); len(match) > 2 {
-		if temp, err := strconv.ParseFloat(match[1], 64); err == nil {
-			gpu.Temperature = temp
+	var foundTemp, foundMem bool
+	for _, part := range parts[1:] {
+		section := codecRe.ReplaceAllString(strings.TrimSpace(part), "")
+
+		match := tempUtilRe.FindStringSubmatch(section)
+		if len(match) > 4 {
+			foundTemp = true
+			// A number with the other decimal separator, such as "48,5" with
+			// the default ".", is left out rather than reported as 0
+			if temp, err := parseNumber(match[1]); err == nil {
+				if match[2] == "℉" || strings.HasSuffix(match[2], "F") {
+					temp = (temp - 32) * 5 / 9
+				}
+				gpu.Temperature = &temp
+			} else {
+				zeroValued = append(zeroValued, "temperature")
+			}
+			if fan, err := parseNumber(match[3]); err == nil {
+				gpu.FanSpeed = &fan
+			}
+			if util, err := parseNumber(match[4]); err == nil {
+				gpu.Utilization = &util
+			} else {
+				zeroValued = append(zeroValued, "utilization")
+			}
+		} else if (strings.Contains(section, "C") || strings.Contains(section, "F")) && strings.Contains(section, "%") {
+			zeroValued = append(zeroValued, "temperature")
 		}
-		if util, err := strconv.ParseFloat(match[2], 64); err == nil {
-			gpu.Utilization = util
+
+		if match := powerRe.FindStringSubmatch(section); len(match) > 1 {
+			if power, err := parseNumber(match[1]); err == nil {
+				gpu.PowerDraw = &power
+			}
+		} else if strings.HasSuffix(section, "W") {
+			zeroValued = append(zeroValued, "power")
 		}
-	}
 
-	// Part 2: Memory usage
-	// Format: "  1871 / 97887 MB"
-	memPart := strings.TrimSpace(parts[2])
-	memRe := regexp.MustCompile(`(\d+)\s*/\s*(\d+)\s*MB`)
-	if match := memRe.FindStringSubmatch(memPart); len(match) > 2 {
-		if used, err := strconv.ParseFloat(match[1], 64); err == nil {
-			gpu.MemoryUsed = used
+		if match := memRe.FindStringSubmatch(section); len(match) > 3 {
+			used, usedErr := parseNumber(match[1])
+			total, totalErr := parseNumber(match[2])
+			// A number with the wrong separator, such as "1,871" written with a
+			// thousands separator, must not be reported as zero memory
+			if usedErr == nil && totalErr == nil {
+				foundMem = true
+				scale := memoryUnitMegabytes[match[3]]
+				used, total = used*scale, total*scale
+				gpu.MemoryUsed, gpu.MemoryTotal = &used, &total
+			} else {
+				zeroValued = append(zeroValued, "memory")
+			}
+		} else if strings.Contains(section, "MB") || strings.Contains(section, "GB") || strings.Contains(section, "GiB") {
+			zeroValued = append(zeroValued, "memory")
 		}
-		if total, err := strconv.ParseFloat(match[2], 64); err == nil {
-			gpu.MemoryTotal = total
+
+		if processSectionRe.MatchString(section) {
+			processes := parseProcesses(section)
+			if len(processes) == 0 {
+				zeroValued = append(zeroValued, "processes")
+			}
+			gpu.Processes = append(gpu.Processes, processes...)
 		}
 	}
 
-	// Part 3 (if exists): Processes
-	// Format: "username(1224M)"
-	if len(parts) > 3 {
-		processesPart := strings.TrimSpace(parts[3])
-		gpu.Processes = parseProcesses(processesPart)
+	if !foundTemp && !foundMem {
+		return gpu, zeroValued, fmt.Errorf("invalid GPU line format: no temperature or memory section")
+	}
+
+	return gpu, zeroValued, nil
+}
+
+// memoryUnitMegabytes converts the memory units gpustat may print to the
+// megabytes reported in GPUInfo. gpustat's "MB" are really MiB, so GiB is 1024
+// of them while a decimal GB is 1000.
+var memoryUnitMegabytes = map[string]float64{
+	"MB":  1,
+	"MiB": 1,
+	"GiB": 1024,
+	"GB":  1000,
+}
+
+// parseNumber parses a number from gpustat output written with the
+// --parse.decimal-separator
+func parseNumber(value string) (float64, error) {
+	if *decimalSeparator != "." {
+		value = strings.Replace(value, *decimalSeparator, ".", 1)
 	}
+	return strconv.ParseFloat(value, 64)
+}
 
-	return gpu, nil
+// parseOptionalFloat parses a number, returning nil for non-numeric values
+// such as nvidia-smi's "[N/A]" or gpustat's "??"
+func parseOptionalFloat(value string) *float64 {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	return &v
 }
 
 // parseProcesses parses the processes part of a GPU line
-// Format: "user1(123M) user2(456M)"
+// Format: "user1(123M) user2(456M)" or with --show-cmd "user1:python(123M)"
 func parseProcesses(processesStr string) []ProcessInfo {
-	var processes []ProcessInfo
-
 	if processesStr == "" {
-		return processes
+		return nil
 	}
 
-	// Match pattern: username(memoryM)
-	processRe := regexp.MustCompile(`(\w+)\((\d+)M\)`)
 	matches := processRe.FindAllStringSubmatch(processesStr, -1)
+	processes := make([]ProcessInfo, 0, len(matches))
 
 	for _, match := range matches {
-		if len(match) > 2 {
+		if len(match) > 4 {
 			username := match[1]
-			if memory, err := strconv.ParseFloat(match[2], 64); err == nil {
+			if memory, err := strconv.ParseFloat(match[4], 64); err == nil {
 				processes = append(processes, ProcessInfo{
 					Username: username,
+					Command:  match[2],
+					PID:      match[3],
 					Memory:   memory,
 				})
 			}
@@ -302,171 +1213,1504 @@ func parseProcesses(processesStr string) []ProcessInfo {
 	return processes
 }
 
-// collectMetrics runs gpustat and updates Prometheus metrics
-func collectMetrics() error {
-	start := time.Now()
+// processTypeLabel returns the type label of a process, "unknown" when
+// nvidia-smi didn't classify it, such as on remote hosts
+func processTypeLabel(proc ProcessInfo) string {
+	if proc.ProcessType == "" {
+		return "unknown"
+	}
+	return proc.ProcessType
+}
 
-	// Run gpustat command
-	cmd := exec.Command(*gpustatPath)
-	output, err := cmd.Output()
-	if err != nil {
-		scrapeSuccess.Set(0)
-		return fmt.Errorf("failed to execute gpustat: %w", err)
+// excludeSelfProcesses drops the processes of the exporter and of its own
+// gpustat invocation, which can briefly show up while it opens the devices.
+// Processes are matched by command name and, when matchPID is set because
+// the pids are from the exporter's own PID namespace, by the exporter's pid,
+// its parent's pid, or being a child of the exporter.
+func excludeSelfProcesses(gpus []GPUInfo, matchPID bool) {
+	self := strconv.Itoa(os.Getpid())
+	var parent string
+	// Don't drop init, which is the parent of daemons and container entrypoints
+	if ppid := os.Getppid(); ppid > 1 {
+		parent = strconv.Itoa(ppid)
 	}
 
-	// Parse output
-	stats, err := parseGPUStatOutput(string(output))
+	for i := range gpus {
+		kept := gpus[i].Processes[:0]
+		for _, proc := range gpus[i].Processes {
+			if *excludeSelfCommand != "" && path.Base(proc.Command) == *excludeSelfCommand {
+				continue
+			}
+			if matchPID && proc.PID != "" &&
+				(proc.PID == self || proc.PID == parent || parentPID(proc.PID) == self) {
+				continue
+			}
+			kept = append(kept, proc)
+		}
+		gpus[i].Processes = kept
+	}
+}
+
+// parentPID returns the parent pid of a local process from /proc, empty when
+// it has exited or /proc is unavailable such as on Windows
+func parentPID(pid string) string {
+	data, err := os.ReadFile(filepath.Join("/proc", pid, "status"))
 	if err != nil {
-		scrapeSuccess.Set(0)
-		return fmt.Errorf("failed to parse gpustat output: %w", err)
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "PPid:"); ok {
+			return strings.TrimSpace(value)
+		}
 	}
+	return ""
+}
 
-	// Reset basic GPU metrics (these are always set for all GPUs)
-	gpuTemperature.Reset()
-	gpuUtilization.Reset()
-	gpuMemoryUsed.Reset()
-	gpuMemoryTotal.Reset()
-	gpuMemoryUtilization.Reset()
-	gpuProcessCount.Reset()
-	driverVersion.Reset()
+// dedupeProcesses drops repeated entries for the same pid on a GPU so they
+// aren't counted twice in per-user totals. Processes without a pid are kept.
+func dedupeProcesses(gpus []GPUInfo) {
+	for i := range gpus {
+		seen := make(map[string]bool, len(gpus[i].Processes))
+		kept := gpus[i].Processes[:0]
+		for _, proc := range gpus[i].Processes {
+			if proc.PID != "" {
+				if seen[proc.PID] {
+					continue
+				}
+				seen[proc.PID] = true
+			}
+			kept = append(kept, proc)
+		}
+		gpus[i].Processes = kept
+	}
+}
 
-	// Track current label sets for user and process metrics
-	currentUserMemoryLabels := make(map[string]bool)
-	currentProcessMemoryLabels := make(map[string]bool)
+// gpustatArgs returns the gpustat arguments required by the enabled features
+func gpustatArgs() []string {
+	var args []string
+	if *gpustatJSONOutput {
+		// The JSON output always includes commands, pids, fan and power
+		return append(args, "--json")
+	}
+	if *showAll {
+		return append(args, "--show-all")
+	}
+	if *showCmd {
+		// gpustat omits the username when only --show-cmd is given
+		args = append(args, "--show-cmd", "--show-user")
+	}
+	if *showFanSpeed {
+		args = append(args, "--show-fan-speed")
+	}
+	if *showPid {
+		args = append(args, "--show-pid")
+	}
+	return args
+}
 
-	// Update driver version
-	if stats.DriverVersion != "" {
-		driverVersion.WithLabelValues(stats.Hostname, stats.DriverVersion).Set(1)
+// gpustatCommand returns the command line that reads the GPUs: gpustat, or
+// rocm-smi with --backend=rocm-smi
+func gpustatCommand() []string {
+	if *backend == "rocm-smi" {
+		return append([]string{*rocmSmiPath}, rocmSmiArgs...)
+	}
+	return append([]string{*gpustatPath}, gpustatArgs()...)
+}
+
+// effectiveCommands returns every command line the exporter runs gpustat with,
+// with the executable resolved on PATH where possible
+func effectiveCommands() []string {
+	var commands [][]string
+	if *sshHosts != "" {
+		for _, target := range sshTargets() {
+			commands = append(commands, sshCommand(target.address))
+		}
+	} else if *gpustatInputFile == "" {
+		commands = append(commands, gpustatCommand())
+	}
+	for _, name := range netnsNames() {
+		commands = append(commands, nsenterCommand(name))
 	}
 
-	// Update GPU metrics
-	for _, gpu := range stats.GPUs {
-		labels := prometheus.Labels{
-			"hostname":  stats.Hostname,
-			"gpu_index": gpu.Index,
-			"gpu_name":  gpu.Name,
+	joined := make([]string, 0, len(commands))
+	for _, command := range commands {
+		if resolved, err := exec.LookPath(command[0]); err == nil {
+			command[0] = resolved
 		}
+		joined = append(joined, strings.Join(command, " "))
+	}
+	return joined
+}
+
+// gpustatParser returns the parser for the configured gpustat output format
+func gpustatParser() func(string) ([]*GPUStatOutput, error) {
+	if *backend == "rocm-smi" {
+		return parseRocmSmiJSON
+	} else if *gpustatJSONOutput {
+		return parseGPUStatJSON
+	} else if *gpustatFormat == "csv" {
+		return parseGPUStatCSV
+	}
+	return parseGPUStatOutput
+}
+
+// execGPUStat runs a gpustat command line, killing it if it outlives
+// --gpustat.timeout, e.g. when gpustat hangs on a wedged driver
+func execGPUStat(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cancel := func() {}
+	if *gpustatTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *gpustatTimeout)
+	}
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	// Stop waiting for output held open by gpustat's own children once it is killed
+	cmd.WaitDelay = time.Second
+	output, err := cmd.Output()
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("timed out after %s", *gpustatTimeout)
+	}
 
-		gpuTemperature.With(labels).Set(gpu.Temperature)
-		gpuUtilization.With(labels).Set(gpu.Utilization)
-		gpuMemoryUsed.With(labels).Set(gpu.MemoryUsed)
-		gpuMemoryTotal.With(labels).Set(gpu.MemoryTotal)
+	message := strings.TrimSpace(stderr.String())
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && message != "" {
+		exitErr.Stderr = stderr.Bytes()
+		return nil, fmt.Errorf("%w: %s", err, message)
+	}
+	// Some gpustat versions print benign warnings even when they succeed
+	if err == nil && message != "" {
+		slog.Debug("gpustat wrote to stderr", "command", name, "stderr", message)
+	}
+	return output, err
+}
 
-		// Calculate memory utilization percentage
-		if gpu.MemoryTotal > 0 {
-			memUtil := (gpu.MemoryUsed / gpu.MemoryTotal) * 100
-			gpuMemoryUtilization.With(labels).Set(memUtil)
+// collectLocal runs gpustat on this host and parses its output
+func collectLocal(ctx context.Context) ([]*GPUStatOutput, error) {
+	var output []byte
+	var err error
+	if *gpustatInputFile != "" {
+		if output, err = os.ReadFile(*gpustatInputFile); err != nil {
+			return nil, fmt.Errorf("failed to read gpustat input file: %w", err)
+		}
+	} else {
+		start := time.Now()
+		execCtx, execSpan := tracer.Start(ctx, "exec")
+		command := gpustatCommand()
+		output, err = execGPUStat(execCtx, command[0], command[1:]...)
+		execSpan.End()
+		execDuration.WithLabelValues("").Set(time.Since(start).Seconds())
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute gpustat: %w", err)
 		}
+	}
+	outputBytes.WithLabelValues("", "").Set(float64(len(output)))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("output_bytes", len(output)))
 
-		// Process count
-		gpuProcessCount.With(labels).Set(float64(len(gpu.Processes)))
+	// Parse output
+	_, parseSpan := tracer.Start(ctx, "parse")
+	parseStart := time.Now()
+	hosts, err := gpustatParser()(string(output))
+	parseSpan.End()
+	parseDuration.Set(time.Since(parseStart).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse gpustat output: %w", err)
+	}
+	return hosts, nil
+}
 
-		// Aggregate memory by user
-		userMemory := make(map[string]float64)
-		for _, proc := range gpu.Processes {
-			userMemory[proc.Username] += proc.Memory
-
-			// Individual process memory
-			procLabelKey := fmt.Sprintf("%s|%s|%s|%s|%.0fM", stats.Hostname, gpu.Index, gpu.Name, proc.Username, proc.Memory)
-			currentProcessMemoryLabels[procLabelKey] = true
-
-			procLabels := prometheus.Labels{
-				"hostname":       stats.Hostname,
-				"gpu_index":      gpu.Index,
-				"gpu_name":       gpu.Name,
-				"username":       proc.Username,
-				"process_memory": fmt.Sprintf("%.0fM", proc.Memory),
-			}
-			gpuProcessMemory.With(procLabels).Set(proc.Memory)
+// collectMetrics runs gpustat and updates Prometheus metrics
+func collectMetrics() error {
+	// Keep serving the last snapshot while in maintenance mode
+	if maintenanceMode.Load() {
+		return nil
+	}
+
+	start := time.Now()
+	ctx, span := tracer.Start(context.Background(), "collectMetrics")
+	defer span.End()
+
+	collect := collectLocal
+	if *sshHosts != "" {
+		collect = collectSSHHosts
+	}
+	scrapesTotal.Inc()
+	hosts, err := collect(ctx)
+	if err != nil {
+		scrapeSuccess.Set(0)
+		consecutiveFailures.Inc()
+		scrapeErrorsTotal.Inc()
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	// nvidia-smi describes the local GPUs, so skip it for combined, remote or
+	// saved output
+	local := len(hosts) == 1 && *sshHosts == "" && *backend == "gpustat" && *gpustatInputFile == ""
+
+	if *netns != "" {
+		hosts = append(hosts, collectNamespaces(ctx)...)
+	}
+
+	for _, stats := range hosts {
+		for _, field := range stats.zeroValued {
+			zeroValuedFields.WithLabelValues(field).Inc()
+		}
+		// Reused SSH results must not be counted again
+		stats.zeroValued = nil
+		dedupeProcesses(stats.GPUs)
+		if *excludeSelf {
+			// Pids from SSH hosts, other namespaces or saved output aren't ours
+			excludeSelfProcesses(stats.GPUs, *sshHosts == "" && *gpustatInputFile == "" && stats.Namespace == "")
+		}
+	}
+
+	// Merge optional nvidia-smi data; failures only lose the extra metrics.
+	// Only the exporter's own namespace is augmented.
+	if local {
+		nvidiaSmiCtx, nvidiaSmiSpan := tracer.Start(ctx, "nvidia-smi")
+		if err := mergeNvidiaSmi(nvidiaSmiCtx, hosts[0].GPUs); err != nil {
+			slog.Warn("Failed to query nvidia-smi", "err", err)
+			nvidiaSmiSpan.SetStatus(codes.Error, err.Error())
 		}
+		nvidiaSmiSpan.End()
+	}
 
-		// User memory totals
-		for username, memory := range userMemory {
-			userLabelKey := fmt.Sprintf("%s|%s|%s|%s", stats.Hostname, gpu.Index, gpu.Name, username)
-			currentUserMemoryLabels[userLabelKey] = true
+	if *labelMaxLength > 0 {
+		for _, stats := range hosts {
+			truncateLabelValues(stats)
+		}
+	}
 
-			userLabels := prometheus.Labels{
-				"hostname":  stats.Hostname,
-				"gpu_index": gpu.Index,
-				"gpu_name":  gpu.Name,
-				"username":  username,
-			}
-			gpuUserMemory.With(userLabels).Set(memory)
+	_, updateSpan := tracer.Start(ctx, "update")
+
+	// Reset basic GPU metrics (these are always set for all GPUs)
+	gpuTemperature.Reset()
+	gpuUtilization.Reset()
+	gpuMemoryUsed.Reset()
+	gpuMemoryTotal.Reset()
+	gpuMemoryUtilization.Reset()
+	gpuFanSpeed.Reset()
+	gpuTempHeadroom.Reset()
+	gpuProcessCount.Reset()
+	gpuMaxProcessMemory.Reset()
+	gpuProcessMemoryP50.Reset()
+	gpuProcessMemoryP90.Reset()
+	gpuTopUserMemory.Reset()
+	gpuPowerDefaultLimit.Reset()
+	gpuPowerEnforcedLimit.Reset()
+	gpuBar1MemoryUsed.Reset()
+	gpuBar1MemoryTotal.Reset()
+	gpuMemoryClockRatio.Reset()
+	gpuClockGraphics.Reset()
+	gpuClockMemory.Reset()
+	gpuPassthrough.Reset()
+	gpuPCIeLinkGen.Reset()
+	gpuPCIeLinkWidth.Reset()
+	gpuPCIeRx.Reset()
+	gpuPCIeTx.Reset()
+	gpuThrottleActive.Reset()
+	gpuInfo.Reset()
+	processCountByCommand.Reset()
+	userMemoryRatioToAverage.Reset()
+	memoryUsedSlope.Reset()
+	driverVersion.Reset()
+	sampleAge.Reset()
+	skippedIdleGPUs.Reset()
+	gpusByUtilizationBand.Reset()
+	gpusIdle.Reset()
+	gpusBusy.Reset()
+	multiGPUProcesses.Reset()
+
+	// Track current label sets for user and process metrics
+	currentUserMemoryLabels := make(trackedSeries, len(previousUserMemoryLabels))
+	currentProcessMemoryLabels := make(trackedSeries, len(previousProcessMemoryLabels))
+	currentUserTotalLabels := make(map[hostUser]bool, len(previousUserTotalLabels))
+
+	gpuCount := 0
+	hostnames := make([]string, 0, len(hosts))
+	for _, stats := range hosts {
+		updateHostMetrics(stats, currentUserMemoryLabels, currentProcessMemoryLabels, currentUserTotalLabels)
+		gpuCount += len(stats.GPUs)
+		hostnames = append(hostnames, stats.Hostname)
+	}
+
+	if *collectECC {
+		eccErrors.update(hosts)
+	}
+
+	if *expectedDriver != "" {
+		updateDriverReadiness(hosts)
+	}
+
+	if *validateEnabled {
+		if err := validateMetrics(prometheus.DefaultGatherer, hosts); err != nil {
+			slog.Warn("Failed to gather metrics for validation", "err", err)
 		}
 	}
 
 	// Delete stale user memory metrics
-	for labelKey := range previousUserMemoryLabels {
-		if !currentUserMemoryLabels[labelKey] {
-			// Parse the label key back into label values
-			parts := strings.Split(labelKey, "|")
-			if len(parts) == 4 {
-				deleted := gpuUserMemory.DeleteLabelValues(parts[0], parts[1], parts[2], parts[3])
-				if deleted {
-					log.Printf("Deleted stale user memory metric: hostname=%s gpu_index=%s gpu_name=%s username=%s",
-						parts[0], parts[1], parts[2], parts[3])
-				}
+	for key, values := range previousUserMemoryLabels {
+		if _, ok := currentUserMemoryLabels[key]; !ok {
+			if gpuUserMemory.DeleteLabelValues(values...) {
+				slog.Info("Deleted stale user memory metric", labelAttrs(userMemoryLabelNames, values)...)
 			}
 		}
 	}
 
 	// Delete stale process memory metrics
-	for labelKey := range previousProcessMemoryLabels {
-		if !currentProcessMemoryLabels[labelKey] {
-			// Parse the label key back into label values
-			parts := strings.Split(labelKey, "|")
-			if len(parts) == 5 {
-				deleted := gpuProcessMemory.DeleteLabelValues(parts[0], parts[1], parts[2], parts[3], parts[4])
-				if deleted {
-					log.Printf("Deleted stale process memory metric: hostname=%s gpu_index=%s gpu_name=%s username=%s process_memory=%s",
-						parts[0], parts[1], parts[2], parts[3], parts[4])
-				}
+	for key, values := range previousProcessMemoryLabels {
+		if _, ok := currentProcessMemoryLabels[key]; !ok {
+			if gpuProcessMemory.DeleteLabelValues(values...) {
+				slog.Info("Deleted stale process memory metric", labelAttrs(processMemoryLabelNames, values)...)
 			}
 		}
 	}
 
+	// Delete stale per-user totals
+	for key := range previousUserTotalLabels {
+		if !currentUserTotalLabels[key] {
+			if userMemoryTotal.DeleteLabelValues(key.labelValues()...) {
+				slog.Info("Deleted stale user memory total metric", labelAttrs(hostLabelNames("username"), key.labelValues())...)
+			}
+		}
+	}
+
+	// Forget the moving averages of users that are gone
+	for key := range userMemoryEMA {
+		if !currentUserTotalLabels[key] {
+			delete(userMemoryEMA, key)
+		}
+	}
+
+	if *slopeWindow > 0 {
+		pruneMemoryHistory(hosts)
+	}
+	if *throttleReasons {
+		pruneThrottleSamples(hosts)
+	}
+
 	// Update the previous label sets for next scrape
 	previousUserMemoryLabels = currentUserMemoryLabels
 	previousProcessMemoryLabels = currentProcessMemoryLabels
+	previousUserTotalLabels = currentUserTotalLabels
+
+	updateSpan.End()
+	span.SetAttributes(attribute.Int("gpu_count", gpuCount))
+	if gpuCount > 0 {
+		gpusSeen.Store(true)
+	}
+	if *webDebug {
+		storeLastHosts(hosts)
+	}
 
 	duration := time.Since(start).Seconds()
 	scrapeDuration.Set(duration)
 	scrapeSuccess.Set(1)
+	consecutiveFailures.Set(0)
+	lastScrapeTimestamp.SetToCurrentTime()
 
-	log.Printf("Successfully scraped %d GPUs from %s in %.3fs", len(stats.GPUs), stats.Hostname, duration)
+	if *logSummaryInterval > 0 {
+		summary.record(duration, false)
+	} else {
+		slog.Debug("Successfully scraped GPUs", "gpus", gpuCount, "hostname", strings.Join(hostnames, ","), "duration_seconds", duration)
+	}
 	return nil
 }
 
+// updateHostMetrics sets the metrics for a single host's parsed output and
+// records the user and process label sets it emitted
+func updateHostMetrics(stats *GPUStatOutput, currentUserMemoryLabels, currentProcessMemoryLabels trackedSeries, currentUserTotalLabels map[hostUser]bool) {
+	// Memory per user summed across all GPUs
+	hostUserMemory := make(map[string]float64)
+
+	// Process memory series per user, set once all GPUs are processed
+	hostProcessSeries := make(map[string][]processSeries)
+
+	// Update driver version
+	if stats.DriverVersion != "" {
+		driverVersion.WithLabelValues(hostLabelValues(stats, stats.DriverVersion)...).Set(1)
+	}
+
+	if !stats.Timestamp.IsZero() {
+		sampleAge.WithLabelValues(hostLabelValues(stats)...).Set(time.Since(stats.Timestamp).Seconds())
+	}
+
+	if *onlyActiveGPUs {
+		skippedIdleGPUs.WithLabelValues(hostLabelValues(stats)...).Set(0)
+	}
+
+	if len(utilizationBands) > 0 {
+		updateUtilizationBands(stats)
+	}
+	updateIdleBusy(stats)
+	if pidLabelEnabled() {
+		updateMultiGPUProcesses(stats)
+	}
+
+	// Update GPU metrics, fanning out across GPUs with --scrape.per-gpu-concurrency
+	updates := make([]gpuUpdate, len(stats.GPUs))
+	if *perGPUConcurrency > 1 {
+		slots := make(chan struct{}, *perGPUConcurrency)
+		var wg sync.WaitGroup
+		for i := range stats.GPUs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				slots <- struct{}{}
+				defer func() { <-slots }()
+				updates[i] = updateGPUMetrics(stats, stats.GPUs[i])
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i, gpu := range stats.GPUs {
+			updates[i] = updateGPUMetrics(stats, gpu)
+		}
+	}
+
+	// Merge in GPU order so the output doesn't depend on which GPU finished first
+	for _, update := range updates {
+		for username, memory := range update.userMemory {
+			hostUserMemory[username] += memory
+		}
+		for _, labels := range update.userLabels {
+			currentUserMemoryLabels.track(userMemoryLabelNames, labels)
+		}
+		for _, s := range update.processSeries {
+			username := s.labels["username"]
+			hostProcessSeries[username] = append(hostProcessSeries[username], s)
+		}
+	}
+
+	updateProcessSeries(stats, hostProcessSeries, currentProcessMemoryLabels)
+
+	for username, memory := range hostUserMemory {
+		key := hostUser{stats.Hostname, stats.Namespace, username}
+		userMemoryTotal.WithLabelValues(key.labelValues()...).Set(memory)
+		currentUserTotalLabels[key] = true
+	}
+
+	if *userEMAAlpha > 0 {
+		updateUserMemoryEMA(stats, hostUserMemory)
+	}
+}
+
+// gpuUpdate holds the per-user memory and series keys emitted for one GPU,
+// merged into the host's totals once all GPUs are done
+type gpuUpdate struct {
+	userMemory    map[string]float64
+	userLabels    []prometheus.Labels
+	processSeries []processSeries
+}
+
+// updateGPUMetrics sets the metrics for a single GPU. It only touches
+// thread-safe state so GPUs can be updated concurrently.
+func updateGPUMetrics(stats *GPUStatOutput, gpu GPUInfo) gpuUpdate {
+	var update gpuUpdate
+	if *onlyActiveGPUs && len(gpu.Processes) == 0 && (gpu.Utilization == nil || *gpu.Utilization == 0) {
+		skippedIdleGPUs.WithLabelValues(hostLabelValues(stats)...).Inc()
+		return update
+	}
+
+	labels := gpuLabels(stats.Hostname, gpu)
+
+	gpuInfo.WithLabelValues(hostLabelValues(stats, gpu.Index, gpu.Name, gpu.UUID, stats.DriverVersion)...).Set(1)
+
+	// Unsupported values are left out rather than reported as 0
+	if gpu.Temperature != nil {
+		gpuTemperature.With(labels).Set(*gpu.Temperature)
+		if limit := temperatureLimit(gpu.Name); limit > 0 {
+			gpuTempHeadroom.With(labels).Set(limit - *gpu.Temperature)
+		}
+	}
+	if gpu.Utilization != nil {
+		gpuUtilization.With(labels).Set(*gpu.Utilization)
+	}
+	if gpu.MemoryUsed != nil {
+		gpuMemoryUsed.With(labels).Set(*gpu.MemoryUsed)
+	}
+	if gpu.MemoryTotal != nil {
+		gpuMemoryTotal.With(labels).Set(*gpu.MemoryTotal)
+	}
+
+	// Calculate memory utilization percentage
+	if gpu.MemoryUsed != nil && gpu.MemoryTotal != nil && *gpu.MemoryTotal > 0 {
+		memUtil := (*gpu.MemoryUsed / *gpu.MemoryTotal) * 100
+		gpuMemoryUtilization.With(labels).Set(memUtil)
+	}
+
+	if *slopeWindow > 0 && gpu.MemoryUsed != nil {
+		updateMemorySlope(labels, memoryHistoryKey(stats, gpu), *gpu.MemoryUsed)
+	}
+
+	if gpu.FanSpeed != nil {
+		gpuFanSpeed.With(labels).Set(*gpu.FanSpeed)
+	}
+	if gpu.PowerDefaultLimit != nil {
+		gpuPowerDefaultLimit.With(labels).Set(*gpu.PowerDefaultLimit)
+	}
+	if gpu.PowerEnforcedLimit != nil {
+		gpuPowerEnforcedLimit.With(labels).Set(*gpu.PowerEnforcedLimit)
+	}
+	if gpu.Bar1MemoryUsed != nil {
+		gpuBar1MemoryUsed.With(labels).Set(*gpu.Bar1MemoryUsed)
+	}
+	if gpu.Bar1MemoryTotal != nil {
+		gpuBar1MemoryTotal.With(labels).Set(*gpu.Bar1MemoryTotal)
+	}
+	if gpu.MemoryClock != nil && gpu.MemoryClockMax != nil && *gpu.MemoryClockMax > 0 {
+		gpuMemoryClockRatio.With(labels).Set(*gpu.MemoryClock / *gpu.MemoryClockMax)
+	}
+	if *clockSpeeds && gpu.GraphicsClock != nil {
+		gpuClockGraphics.With(labels).Set(*gpu.GraphicsClock)
+	}
+	if *clockSpeeds && gpu.MemoryClock != nil {
+		gpuClockMemory.With(labels).Set(*gpu.MemoryClock)
+	}
+	if gpu.Passthrough != nil {
+		gpuPassthrough.With(labels).Set(*gpu.Passthrough)
+	}
+	if gpu.PCIeLinkGen != nil {
+		gpuPCIeLinkGen.With(labels).Set(*gpu.PCIeLinkGen)
+	}
+	if gpu.PCIeLinkWidth != nil {
+		gpuPCIeLinkWidth.With(labels).Set(*gpu.PCIeLinkWidth)
+	}
+	if gpu.PCIeRx != nil {
+		gpuPCIeRx.With(labels).Set(*gpu.PCIeRx)
+	}
+	if gpu.PCIeTx != nil {
+		gpuPCIeTx.With(labels).Set(*gpu.PCIeTx)
+	}
+	if gpu.ThrottleReasons != nil {
+		elapsed := throttleElapsed(memoryHistoryKey(stats, gpu), labels)
+		for reason, active := range gpu.ThrottleReasons {
+			throttleLabels := gpuLabels(stats.Hostname, gpu)
+			throttleLabels["reason"] = reason
+			value, seconds := 0.0, 0.0
+			if active {
+				value, seconds = 1, elapsed
+			}
+			gpuThrottleActive.With(throttleLabels).Set(value)
+			gpuThrottleSeconds.With(throttleLabels).Add(seconds)
+		}
+	}
+
+	// Process count
+	gpuProcessCount.With(labels).Set(float64(len(gpu.Processes)))
+
+	// Aggregate memory by user
+	userMemory := make(map[string]float64, len(gpu.Processes))
+	update.userMemory = userMemory
+	measured := make([]ProcessInfo, 0, len(gpu.Processes))
+	var maxProcess *ProcessInfo
+	for _, proc := range gpu.Processes {
+		if proc.Command != "" {
+			processCountByCommand.WithLabelValues(hostLabelValues(stats, path.Base(proc.Command))...).Inc()
+		}
+		if proc.MemoryUnknown {
+			continue
+		}
+
+		measured = append(measured, proc)
+		userMemory[proc.Username] += proc.Memory
+		if maxProcess == nil || proc.Memory > maxProcess.Memory {
+			maxProcess = &measured[len(measured)-1]
+		}
+	}
+
+	if maxProcess != nil {
+		maxLabels := gpuLabels(stats.Hostname, gpu)
+		maxLabels["username"] = maxProcess.Username
+		gpuMaxProcessMemory.With(maxLabels).Set(maxProcess.Memory)
+
+		gpuProcessMemoryP50.With(labels).Set(processMemoryPercentile(measured, 50))
+		gpuProcessMemoryP90.With(labels).Set(processMemoryPercentile(measured, 90))
+	}
+
+	processes := topProcesses(measured, *topProcessesPerGPU)
+	if *processKey == "hash" {
+		processes = mergeProcessesByCommand(processes)
+	}
+
+	for _, proc := range processes {
+		// Individual process memory
+		procLabels := gpuLabels(stats.Hostname, gpu)
+		procLabels["username"] = proc.Username
+		if *processKey == "hash" {
+			procLabels["process"] = processHash(proc)
+		} else {
+			procLabels["process_memory"] = fmt.Sprintf("%.0fM", proc.Memory)
+		}
+		if *collectProcessType {
+			procLabels["type"] = processTypeLabel(proc)
+		}
+		if commandLabelEnabled() {
+			procLabels["command"] = proc.Command
+		}
+		if pidLabelEnabled() {
+			procLabels["pid"] = proc.PID
+		}
+		update.processSeries = append(update.processSeries, processSeries{procLabels, proc.Memory})
+	}
+
+	// User memory totals
+	var topUser string
+	for username, memory := range userMemory {
+		userLabels := gpuLabels(stats.Hostname, gpu)
+		userLabels["username"] = username
+		update.userLabels = append(update.userLabels, userLabels)
+
+		gpuUserMemory.With(userLabels).Set(bucketMemory(memory, *userMemoryBucket))
+
+		// Break ties by name so the reported user doesn't flap
+		if topUser == "" || memory > userMemory[topUser] || (memory == userMemory[topUser] && username < topUser) {
+			topUser = username
+		}
+	}
+
+	if topUser != "" {
+		topLabels := gpuLabels(stats.Hostname, gpu)
+		topLabels["username"] = topUser
+		gpuTopUserMemory.With(topLabels).Set(userMemory[topUser])
+	}
+
+	return update
+}
+
+// updateProcessSeries sets each user's process memory series. With a user
+// refresh interval, a user whose set of series changed again within the
+// interval keeps their previous series until it has passed.
+func updateProcessSeries(stats *GPUStatOutput, series map[string][]processSeries, currentProcessMemoryLabels trackedSeries) {
+	now := time.Now()
+
+	for username, userSeries := range series {
+		keys := make(trackedSeries, len(userSeries))
+		for _, s := range userSeries {
+			keys.track(processMemoryLabelNames, s.labels)
+		}
+
+		if *userRefreshInterval > 0 {
+			userKey := hostUser{stats.Hostname, stats.Namespace, username}
+			previous, seen := userProcessKeys[userKey]
+			if seen && !sameSeries(keys, previous) {
+				if now.Sub(userProcessRefreshed[userKey]) < *userRefreshInterval {
+					userMetricThrottled.WithLabelValues(userKey.labelValues()...).Inc()
+					for key, values := range previous {
+						currentProcessMemoryLabels[key] = values
+					}
+					continue
+				}
+				userProcessRefreshed[userKey] = now
+			} else if !seen {
+				userProcessRefreshed[userKey] = now
+			}
+			userProcessKeys[userKey] = keys
+		}
+
+		for key, values := range keys {
+			currentProcessMemoryLabels[key] = values
+		}
+		for _, s := range userSeries {
+			gpuProcessMemory.With(s.labels).Set(s.memory)
+		}
+	}
+
+	// Forget users without processes so their next series start fresh
+	for userKey := range userProcessKeys {
+		if _, ok := series[userKey.username]; userKey.hostname == stats.Hostname && userKey.namespace == stats.Namespace && !ok {
+			delete(userProcessKeys, userKey)
+			delete(userProcessRefreshed, userKey)
+		}
+	}
+}
+
+// promScrapeConfig is the part of a Prometheus scrape config written by
+// scrapeConfig
+type promScrapeConfig struct {
+	JobName        string             `yaml:"job_name"`
+	ScrapeInterval string             `yaml:"scrape_interval"`
+	Scheme         string             `yaml:"scheme"`
+	MetricsPath    string             `yaml:"metrics_path"`
+	BasicAuth      *promBasicAuth     `yaml:"basic_auth,omitempty"`
+	StaticConfigs  []promStaticConfig `yaml:"static_configs"`
+}
+
+type promBasicAuth struct {
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+type promStaticConfig struct {
+	Targets []string `yaml:"targets"`
+}
+
+// scrapeConfig returns a Prometheus scrape_configs snippet for scraping this
+// exporter at target, matching its metrics path and scrape interval
+func scrapeConfig(target string) (string, error) {
+	config := promScrapeConfig{
+		JobName:        "gpustat",
+		ScrapeInterval: scrapeInterval.String(),
+		Scheme:         "http",
+		MetricsPath:    *metricsPath,
+		StaticConfigs:  []promStaticConfig{{Targets: []string{target}}},
+	}
+	if *tlsCertFile != "" {
+		config.Scheme = "https"
+	}
+	// The password is only stored as a hash, so leave a file for the user to fill in
+	if *authUsername != "" {
+		config.BasicAuth = &promBasicAuth{Username: *authUsername, PasswordFile: "/etc/prometheus/gpustat-password"}
+	}
+
+	// Marshal rather than format, so the Host header can't inject YAML
+	var b strings.Builder
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(map[string][]promScrapeConfig{"scrape_configs": {config}}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// updateDriverReadiness checks that every host reports a driver version
+// starting with the expected version
+func updateDriverReadiness(hosts []*GPUStatOutput) {
+	matches := len(hosts) > 0
+	for _, stats := range hosts {
+		if !strings.HasPrefix(stats.DriverVersion, *expectedDriver) {
+			matches = false
+		}
+	}
+
+	driverReady.Store(matches)
+	if matches {
+		driverVersionMatches.Set(1)
+	} else {
+		driverVersionMatches.Set(0)
+	}
+}
+
+// setMaintenanceMode enables or disables maintenance mode
+func setMaintenanceMode(enabled bool) {
+	maintenanceMode.Store(enabled)
+	if enabled {
+		maintenanceGauge.Set(1)
+	} else {
+		maintenanceGauge.Set(0)
+	}
+}
+
+// maintenanceHandler toggles maintenance mode on POST, or sets it with
+// ?enabled=true|false
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Toggle by default, or set explicitly with ?enabled=true|false
+	enabled := !maintenanceMode.Load()
+	if value := r.URL.Query().Get("enabled"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "Invalid enabled value", http.StatusBadRequest)
+			return
+		}
+		enabled = parsed
+	}
+
+	setMaintenanceMode(enabled)
+	slog.Info("Maintenance mode changed", "enabled", enabled)
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = fmt.Fprintf(w, "maintenance=%t\n", enabled)
+}
+
+// gpustatInstallHint returns the platform-specific command to install gpustat
+func gpustatInstallHint() string {
+	if runtime.GOOS == "windows" {
+		return "pip install gpustat"
+	}
+	return "sudo apt install gpustat"
+}
+
+// topProcesses returns the n processes using the most memory, with the rest
+// summed into a single "__others__" entry. n <= 0 returns all processes.
+func topProcesses(processes []ProcessInfo, n int) []ProcessInfo {
+	if n <= 0 || len(processes) <= n {
+		return processes
+	}
+
+	sorted := make([]ProcessInfo, len(processes))
+	copy(sorted, processes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Memory > sorted[j].Memory
+	})
+
+	others := ProcessInfo{Username: othersUsername}
+	for _, proc := range sorted[n:] {
+		others.Memory += proc.Memory
+	}
+
+	return append(sorted[:n], others)
+}
+
+// temperatureLimit returns the thermal limit for a GPU model, falling back to
+// --temperature.default-limit for unknown models
+func temperatureLimit(name string) float64 {
+	words := strings.FieldsFunc(strings.ToUpper(name), func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_'
+	})
+	for _, model := range modelTempLimits {
+		for _, word := range words {
+			if word == model.Model {
+				return model.Limit
+			}
+		}
+	}
+	return *defaultTempLimit
+}
+
+// processMemoryPercentile returns the nearest-rank percentile of the memory
+// used by processes, which must not be empty
+func processMemoryPercentile(processes []ProcessInfo, percentile float64) float64 {
+	memory := make([]float64, len(processes))
+	for i, proc := range processes {
+		memory[i] = proc.Memory
+	}
+	sort.Float64s(memory)
+
+	rank := int(math.Ceil(percentile / 100 * float64(len(memory))))
+	if rank < 1 {
+		rank = 1
+	}
+	return memory[rank-1]
+}
+
+// bucketMemory rounds memory down to a multiple of bucket, returning it
+// unchanged when bucket is not positive
+func bucketMemory(memory, bucket float64) float64 {
+	if bucket <= 0 {
+		return memory
+	}
+	return math.Floor(memory/bucket) * bucket
+}
+
+// parseUtilizationBands parses comma-separated increasing upper edges into
+// bands, e.g. "0,25,75,100" into 0, 1-25, 26-75 and 76-100
+func parseUtilizationBands(spec string) ([]utilizationBand, error) {
+	var bands []utilizationBand
+	low := 0.0
+	for _, edge := range strings.Split(spec, ",") {
+		high, err := strconv.ParseFloat(strings.TrimSpace(edge), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid band edge %q", edge)
+		}
+		if high < low {
+			return nil, fmt.Errorf("band edges must be increasing, got %v after %v", high, low-1)
+		}
+
+		name := fmt.Sprintf("%g-%g", low, high)
+		if low == high {
+			name = fmt.Sprintf("%g", high)
+		}
+		bands = append(bands, utilizationBand{Low: low, High: high, Name: name})
+		low = high + 1
+	}
+	return bands, nil
+}
+
+// updateUtilizationBands counts the host's GPUs in each utilization band,
+// reporting empty bands as 0
+func updateUtilizationBands(stats *GPUStatOutput) {
+	for _, band := range utilizationBands {
+		gpusByUtilizationBand.WithLabelValues(hostLabelValues(stats, band.Name)...).Set(0)
+	}
+
+	for _, gpu := range stats.GPUs {
+		if gpu.Utilization == nil {
+			continue
+		}
+		for _, band := range utilizationBands {
+			if *gpu.Utilization <= band.High {
+				gpusByUtilizationBand.WithLabelValues(hostLabelValues(stats, band.Name)...).Inc()
+				break
+			}
+		}
+	}
+}
+
+// updateIdleBusy counts the host's idle and busy GPUs, including any skipped
+// by --metrics.only-active-gpus. GPUs without a utilization are not counted.
+func updateIdleBusy(stats *GPUStatOutput) {
+	var idle, busy float64
+	for _, gpu := range stats.GPUs {
+		if gpu.Utilization == nil {
+			continue
+		}
+		if *gpu.Utilization > *idleThreshold {
+			busy++
+		} else {
+			idle++
+		}
+	}
+	gpusIdle.WithLabelValues(hostLabelValues(stats)...).Set(idle)
+	gpusBusy.WithLabelValues(hostLabelValues(stats)...).Set(busy)
+}
+
+// updateMultiGPUProcesses counts the pids listed on more than one of the
+// host's GPUs. Processes without a pid can't be correlated and are skipped.
+func updateMultiGPUProcesses(stats *GPUStatOutput) {
+	gpusByPID := make(map[string]int)
+	for _, gpu := range stats.GPUs {
+		seen := make(map[string]bool, len(gpu.Processes))
+		for _, proc := range gpu.Processes {
+			if proc.PID != "" && !seen[proc.PID] {
+				seen[proc.PID] = true
+				gpusByPID[proc.PID]++
+			}
+		}
+	}
+
+	var count float64
+	for _, gpus := range gpusByPID {
+		if gpus > 1 {
+			count++
+		}
+	}
+	multiGPUProcesses.WithLabelValues(hostLabelValues(stats)...).Set(count)
+}
+
+// processLabelName returns the label identifying a process memory series
+func processLabelName() string {
+	if *processKey == "hash" {
+		return "process"
+	}
+	return "process_memory"
+}
+
+// pidLabelEnabled reports whether gpustat is run with pids, which then label
+// the process memory series
+func pidLabelEnabled() bool {
+	return *showPid || *showAll || *gpustatJSONOutput
+}
+
+// commandLabelEnabled reports whether gpustat is run with commands, which
+// then label the process memory series
+func commandLabelEnabled() bool {
+	return *showCmd || *showAll || *gpustatJSONOutput
+}
+
+// processExtraLabels returns the labels process memory series carry on top of
+// the per-GPU labels
+func processExtraLabels() []string {
+	labels := []string{"username", processLabelName()}
+	if *collectProcessType {
+		labels = append(labels, "type")
+	}
+	if commandLabelEnabled() {
+		labels = append(labels, "command")
+	}
+	if pidLabelEnabled() {
+		labels = append(labels, "pid")
+	}
+	return labels
+}
+
+// processHash returns a stable key for a process derived from its username,
+// command and pid (when shown)
+func processHash(proc ProcessInfo) string {
+	h := fnv.New64a()
+	h.Write([]byte(proc.Username + "\x00" + proc.Command + "\x00" + proc.PID))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// mergeProcessesByCommand sums the memory of processes sharing a username,
+// command and pid, since they map to the same process hash
+func mergeProcessesByCommand(processes []ProcessInfo) []ProcessInfo {
+	merged := make([]ProcessInfo, 0, len(processes))
+	index := make(map[string]int)
+	for _, proc := range processes {
+		key := proc.Username + "\x00" + proc.Command + "\x00" + proc.PID
+		if i, ok := index[key]; ok {
+			merged[i].Memory += proc.Memory
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, proc)
+	}
+	return merged
+}
+
+// updateUserMemoryEMA compares each user's memory with their moving average,
+// then folds the current value into the average
+func updateUserMemoryEMA(stats *GPUStatOutput, userMemory map[string]float64) {
+	for username, memory := range userMemory {
+		key := hostUser{stats.Hostname, stats.Namespace, username}
+		average, seen := userMemoryEMA[key]
+		if !seen {
+			userMemoryEMA[key] = memory
+			userMemoryRatioToAverage.WithLabelValues(key.labelValues()...).Set(1)
+			continue
+		}
+
+		if average > 0 {
+			userMemoryRatioToAverage.WithLabelValues(key.labelValues()...).Set(memory / average)
+		}
+		userMemoryEMA[key] = *userEMAAlpha*memory + (1-*userEMAAlpha)*average
+	}
+}
+
+// memoryHistoryKey identifies a GPU in memoryHistory
+func memoryHistoryKey(stats *GPUStatOutput, gpu GPUInfo) string {
+	return stats.Hostname + "|" + gpu.Namespace + "|" + gpu.Index
+}
+
+// scrapedGPUKeys returns the memoryHistoryKey of every GPU in the scrape
+func scrapedGPUKeys(hosts []*GPUStatOutput) map[string]bool {
+	current := make(map[string]bool)
+	for _, stats := range hosts {
+		for _, gpu := range stats.GPUs {
+			current[memoryHistoryKey(stats, gpu)] = true
+		}
+	}
+	return current
+}
+
+// pruneMemoryHistory drops the samples of GPUs missing from the scrape, e.g.
+// on hosts that are gone
+func pruneMemoryHistory(hosts []*GPUStatOutput) {
+	current := scrapedGPUKeys(hosts)
+
+	memoryHistoryMu.Lock()
+	defer memoryHistoryMu.Unlock()
+	for key := range memoryHistory {
+		if !current[key] {
+			delete(memoryHistory, key)
+		}
+	}
+}
+
+// throttleSample is when a GPU's throttle reasons were last sampled, with the
+// labels of its throttle series
+type throttleSample struct {
+	at     time.Time
+	labels prometheus.Labels
+}
+
+// throttleElapsed records a throttle reason sample for the GPU and returns
+// the seconds since its previous one, 0 for the first. Gaps longer than two
+// scrape intervals, such as after maintenance mode, aren't counted.
+func throttleElapsed(key string, labels prometheus.Labels) float64 {
+	throttleSamplesMu.Lock()
+	defer throttleSamplesMu.Unlock()
+
+	now := time.Now()
+	previous, seen := throttleSamples[key]
+	throttleSamples[key] = throttleSample{at: now, labels: labels}
+	if !seen {
+		return 0
+	}
+
+	elapsed := now.Sub(previous.at)
+	if !*scrapeOnDemand && elapsed > 2**scrapeInterval {
+		return 0
+	}
+	return elapsed.Seconds()
+}
+
+// pruneThrottleSamples forgets the GPUs missing from the scrape and deletes
+// their throttle duration series
+func pruneThrottleSamples(hosts []*GPUStatOutput) {
+	current := scrapedGPUKeys(hosts)
+
+	throttleSamplesMu.Lock()
+	defer throttleSamplesMu.Unlock()
+	for key, sample := range throttleSamples {
+		if !current[key] {
+			gpuThrottleSeconds.DeletePartialMatch(sample.labels)
+			delete(throttleSamples, key)
+		}
+	}
+}
+
+// updateMemorySlope records a memory sample for the GPU and sets the slope of
+// a least-squares fit over the samples within the slope window
+func updateMemorySlope(labels prometheus.Labels, key string, memory float64) {
+	memoryHistoryMu.Lock()
+	defer memoryHistoryMu.Unlock()
+
+	now := time.Now()
+	samples := append(memoryHistory[key], memorySample{at: now, memory: memory})
+
+	// Drop samples that have left the window
+	first := 0
+	for first < len(samples) && now.Sub(samples[first].at) > *slopeWindow {
+		first++
+	}
+	samples = samples[first:]
+	memoryHistory[key] = samples
+
+	if len(samples) < 2 {
+		return
+	}
+
+	var meanX, meanY float64
+	for _, sample := range samples {
+		meanX += sample.at.Sub(samples[0].at).Minutes()
+		meanY += sample.memory
+	}
+	meanX /= float64(len(samples))
+	meanY /= float64(len(samples))
+
+	var covariance, variance float64
+	for _, sample := range samples {
+		dx := sample.at.Sub(samples[0].at).Minutes() - meanX
+		covariance += dx * (sample.memory - meanY)
+		variance += dx * dx
+	}
+	if variance > 0 {
+		memoryUsedSlope.With(labels).Set(covariance / variance)
+	}
+}
+
+// record adds a scrape result to the summary
+func (s *scrapeSummary) record(duration float64, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scrapes++
+	if failed {
+		s.failures++
+	} else {
+		s.totalDuration += duration
+	}
+}
+
+// flush logs the aggregated results and starts a new summary period
+func (s *scrapeSummary) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	avgDuration := 0.0
+	if successes := s.scrapes - s.failures; successes > 0 {
+		avgDuration = s.totalDuration / float64(successes)
+	}
+	slog.Info("Scrape summary", "scrapes", s.scrapes, "failures", s.failures, "average_duration_seconds", avgDuration)
+
+	s.scrapes = 0
+	s.failures = 0
+	s.totalDuration = 0
+}
+
+// summaryLogger logs a scrape summary at the specified interval
+func summaryLogger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		summary.flush()
+	}
+}
+
+// waitForBinary polls for a binary until it is found or the timeout elapses.
+// LookPath also resolves gpustat.exe via PATHEXT on Windows.
+func waitForBinary(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for attempt := 0; ; attempt++ {
+		_, err := exec.LookPath(name)
+		if err == nil || !time.Now().Before(deadline) {
+			return err
+		}
+
+		if attempt == 0 {
+			slog.Info("Waiting for binary to become available", "binary", name, "timeout", timeout.String())
+		}
+		time.Sleep(time.Second)
+	}
+}
+
 // metricsCollector runs collectMetrics at the specified interval
-func metricsCollector(interval time.Duration) {
+func metricsCollector(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	// Collect metrics immediately on startup
 	if err := collectMetrics(); err != nil {
-		log.Printf("Error collecting metrics: %v", err)
+		slog.Error("Error collecting metrics", "err", err)
+		summary.record(0, true)
 	}
+	pushMetrics()
+	pushGraphite()
+	writeTextfile()
+
+	for {
+		// A scrape in progress always finishes before shutdown is noticed
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
-	for range ticker.C {
 		if err := collectMetrics(); err != nil {
-			log.Printf("Error collecting metrics: %v", err)
+			slog.Error("Error collecting metrics", "err", err)
+			summary.record(0, true)
 		}
+		pushMetrics()
+		pushGraphite()
+		writeTextfile()
 	}
 }
 
+// onDemandHandler runs a scrape before serving each metrics request. Requests
+// are serialized so concurrent scrapes never run gpustat in parallel, and a
+// failed scrape returns 503 so Prometheus marks the target down.
+func onDemandHandler(next http.Handler) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err := collectMetrics(); err != nil {
+			slog.Error("Error collecting metrics", "err", err)
+			summary.record(0, true)
+			http.Error(w, fmt.Sprintf("Error collecting metrics: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		pushMetrics()
+		pushGraphite()
+		writeTextfile()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func main() {
 	flag.Parse()
 
+	if err := setupLogging(*logFormat, *logLevel); err != nil {
+		fatalf("Invalid logging configuration: %v", err)
+	}
+
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile); err != nil {
+			fatalf("Invalid --config.file: %v", err)
+		}
+	}
+
+	for flagName, value := range map[string]string{"metric.namespace": *metricNamespace, "metric.driver-info-namespace": *driverInfoNamespace} {
+		if !metricNamespaceRe.MatchString(value) {
+			fatalf("Invalid --%s %q: must start with a letter, underscore or colon followed by letters, digits, underscores or colons", flagName, value)
+		}
+	}
+
+	if *hostnameLabelRegex != "" {
+		if err := setupHostnameRegex(*hostnameLabelRegex); err != nil {
+			fatalf("Invalid --labels.hostname-regex: %v", err)
+		}
+	}
+
+	if *utilizationBandEdges != "" {
+		bands, err := parseUtilizationBands(*utilizationBandEdges)
+		if err != nil {
+			fatalf("Invalid --metrics.utilization-bands: %v", err)
+		}
+		utilizationBands = bands
+	}
+	initMetrics()
+	registerMetrics()
+	startTime.Set(float64(time.Now().Unix()))
+	buildInfo.WithLabelValues(version, runtime.Version(), revision).Set(1)
+
+	if *backend != "gpustat" && *backend != "rocm-smi" {
+		fatalf("--backend must be gpustat or rocm-smi, got %q", *backend)
+	}
+	if *backend == "rocm-smi" && (*gpustatJSONOutput || *gpustatFormat != "table") {
+		fatalf("--gpustat.json and --gpustat.format only apply to --backend=gpustat")
+	}
+
 	// Check if gpustat is available
-	if _, err := exec.LookPath(*gpustatPath); err != nil {
-		log.Fatalf("gpustat command not found. Please install it: sudo apt install gpustat")
+	if *gpustatInputFile != "" {
+		// Nothing is executed, but a missing file only fails the scrapes
+		if *sshHosts != "" {
+			fatalf("--gpustat.input-file can't be combined with --gpustat.ssh-hosts")
+		}
+	} else if *sshHosts != "" {
+		// gpustat only has to exist on the remote hosts
+		if *sshConcurrency < 1 {
+			fatalf("--gpustat.ssh-concurrency must be at least 1, got %d", *sshConcurrency)
+		}
+		if _, err := exec.LookPath("ssh"); err != nil {
+			fatalf("ssh command not found, required by --gpustat.ssh-hosts")
+		}
+		if _, err := parseSSHTargets(*sshHosts); err != nil {
+			fatalf("Invalid --gpustat.ssh-hosts: %v", err)
+		}
+		for name, file := range map[string]string{"--ssh.known-hosts": *sshKnownHosts, "--ssh.agent-socket": *sshAgentSocket} {
+			if _, err := os.Stat(file); file != "" && err != nil {
+				fatalf("Invalid %s: %v", name, err)
+			}
+		}
+	} else if *backend == "rocm-smi" {
+		if err := waitForBinary(*rocmSmiPath, *gpustatWaitForBinary); err != nil {
+			fatalf("rocm-smi command not found. Please install ROCm or set --rocm-smi.path")
+		}
+	} else if err := waitForBinary(*gpustatPath, *gpustatWaitForBinary); err != nil {
+		fatalf("gpustat command not found. Please install it: %s", gpustatInstallHint())
+	}
+
+	if *collectProcessType && !pidLabelEnabled() {
+		fatalf("--collect.process-type needs process ids, set --gpustat.show-pid, --gpustat.show-all or --gpustat.json")
+	}
+
+	if err := validateNamespaces(); err != nil {
+		fatalf("Invalid --netns: %v", err)
+	}
+
+	if *perGPUConcurrency < 1 {
+		fatalf("--scrape.per-gpu-concurrency must be at least 1, got %d", *perGPUConcurrency)
+	}
+
+	if *userEMAAlpha < 0 || *userEMAAlpha > 1 {
+		fatalf("--metrics.user-ema-alpha must be between 0 and 1, got %v", *userEMAAlpha)
+	}
+
+	if nvidiaSmiEnabled() && *backend == "gpustat" {
+		resolveNvidiaSmiPath()
+	}
+
+	for _, command := range effectiveCommands() {
+		commandInfo.WithLabelValues(command).Set(1)
+	}
+
+	if *gpustatFormat != "table" && *gpustatFormat != "csv" {
+		fatalf("--gpustat.format must be table or csv, got %q", *gpustatFormat)
+	}
+	if *listenAddress == "" && *textfileOutput == "" {
+		fatalf("--web.listen-address can only be empty when --textfile.output is set")
+	}
+	if *listenAddress == "" && *scrapeOnDemand {
+		fatalf("--scrape.on-demand requires --web.listen-address")
+	}
+
+	if *decimalSeparator != "." && *decimalSeparator != "," {
+		fatalf("--parse.decimal-separator must be . or ,, got %q", *decimalSeparator)
+	}
+	if *gpustatJSONOutput && *gpustatFormat == "csv" {
+		fatalf("--gpustat.json cannot be combined with --gpustat.format=csv")
+	}
+
+	if *processKey != "memory" && *processKey != "hash" {
+		fatalf("--metrics.process-key must be memory or hash, got %q", *processKey)
+	}
+
+	if *excludeSelf && !commandLabelEnabled() && !pidLabelEnabled() {
+		fatalf("--metrics.exclude-self requires --gpustat.show-cmd, --gpustat.show-pid, --gpustat.show-all or --gpustat.json to see process commands or pids")
+	}
+
+	var certs *certReloader
+	if *tlsCertFile != "" || *tlsKeyFile != "" {
+		if *tlsCertFile == "" || *tlsKeyFile == "" {
+			fatalf("--web.tls-cert-file and --web.tls-key-file must be set together")
+		}
+		var err error
+		if certs, err = newCertReloader(*tlsCertFile, *tlsKeyFile); err != nil {
+			fatalf("Invalid TLS configuration: %v", err)
+		}
+	}
+
+	var passwordHash []byte
+	if *authUsername != "" || *authPasswordFile != "" {
+		if *authUsername == "" || *authPasswordFile == "" {
+			fatalf("--web.auth-username and --web.auth-password-file must be set together")
+		}
+		var err error
+		if passwordHash, err = loadPasswordHash(*authPasswordFile); err != nil {
+			fatalf("Invalid basic auth configuration: %v", err)
+		}
+	}
+
+	if *pushgatewayURL != "" {
+		if err := setupPushgateway(); err != nil {
+			fatalf("Invalid Pushgateway configuration: %v", err)
+		}
+	}
+
+	if *graphiteAddress != "" {
+		setupGraphite(*graphiteAddress)
+	}
+
+	if *ownershipFile != "" {
+		if err := setupOwnership(*ownershipFile); err != nil {
+			fatalf("Invalid --ownership.file: %v", err)
+		}
+	}
+
+	setMaintenanceMode(*maintenanceStart)
+
+	stopTracing := func(context.Context) error { return nil }
+	if *otelTracesEndpoint != "" {
+		var err error
+		if stopTracing, err = setupTracing(*otelTracesEndpoint); err != nil {
+			fatalf("Invalid tracing configuration: %v", err)
+		}
+	}
+
+	if *logSummaryInterval > 0 {
+		go summaryLogger(*logSummaryInterval)
+	}
+
+	if *exitIfNoGPUs > 0 {
+		time.AfterFunc(*exitIfNoGPUs, func() {
+			// Maintenance mode skips scrapes, so no GPUs is expected then
+			if !gpusSeen.Load() && !maintenanceMode.Load() {
+				fatalf("No GPUs detected within %s of startup, exiting", *exitIfNoGPUs)
+			}
+		})
 	}
 
-	// Start metrics collector in background
-	go metricsCollector(*scrapeInterval)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *listenAddress == "" {
+		slog.Info("Starting gpustat-exporter without HTTP", "version", version, "textfile", *textfileOutput)
+		metricsCollector(ctx, *scrapeInterval)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		shutdown(shutdownCtx, stopTracing)
+		return
+	}
 
 	// Setup HTTP handlers
-	http.Handle(*metricsPath, promhttp.Handler())
+	metricsHandler := promhttp.Handler()
+	collectorDone := make(chan struct{})
+	if *scrapeOnDemand {
+		metricsHandler = onDemandHandler(metricsHandler)
+		close(collectorDone)
+	} else {
+		// Start metrics collector in background
+		go func() {
+			defer close(collectorDone)
+			metricsCollector(ctx, *scrapeInterval)
+		}()
+	}
+	// Authenticate before on-demand scrapes so anonymous requests can't run gpustat
+	if passwordHash != nil {
+		metricsHandler = basicAuth(metricsHandler, *authUsername, passwordHash)
+	}
+	http.Handle(*metricsPath, metricsHandler)
+	if *webDebug {
+		// Process lists include usernames and commands, so protect them like the metrics
+		var debugHandler http.Handler = http.HandlerFunc(debugGPUs)
+		if passwordHash != nil {
+			debugHandler = basicAuth(debugHandler, *authUsername, passwordHash)
+		}
+		http.Handle("/debug/gpus", debugHandler)
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		_, _ = fmt.Fprintf(w, `<html>
@@ -489,17 +2733,84 @@ func main() {
 		_, _ = fmt.Fprintf(w, "%s\n", version)
 	})
 
+	// Maintenance mode freezes every metric, so it needs the same credentials
+	// and stays disabled until there are some
+	var maintenance http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance mode can only be toggled with basic auth configured", http.StatusForbidden)
+	})
+	if passwordHash != nil {
+		maintenance = basicAuth(http.HandlerFunc(maintenanceHandler), *authUsername, passwordHash)
+	}
+	http.Handle("/maintenance", maintenance)
+
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = fmt.Fprint(w, "OK")
 	})
 
+	http.HandleFunc("/scrape-config", func(w http.ResponseWriter, r *http.Request) {
+		config, err := scrapeConfig(r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = fmt.Fprint(w, config)
+	})
+
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if *expectedDriver != "" && !driverReady.Load() {
+			http.Error(w, "Driver version does not match "+*expectedDriver, http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprint(w, "OK")
+	})
+
 	// Start HTTP server
-	log.Printf("Starting gpustat-exporter version %s on %s", version, *listenAddress)
-	log.Printf("Metrics available at %s%s", *listenAddress, *metricsPath)
-	log.Printf("Scrape interval: %s", *scrapeInterval)
+	slog.Info("Starting gpustat-exporter", "version", version, "address", *listenAddress)
+	slog.Info("Metrics available", "address", *listenAddress, "path", *metricsPath)
+	if *scrapeOnDemand {
+		slog.Info("Scraping on demand")
+	} else {
+		slog.Info("Scraping on an interval", "interval", scrapeInterval.String())
+	}
+
+	server := &http.Server{Addr: *listenAddress}
+	serverErr := make(chan error, 1)
+	go func() {
+		if certs != nil {
+			server.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+			serverErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serverErr:
+		fatalf("Error starting HTTP server: %v", err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the process right away
+	stop()
+	slog.Info("Shutting down", "timeout", shutdownTimeout.String())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("HTTP server did not shut down cleanly", "err", err)
+	}
+	<-collectorDone
+	shutdown(shutdownCtx, stopTracing)
+}
 
-	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
-		log.Fatalf("Error starting HTTP server: %v", err)
+// shutdown cleans up after the HTTP server and collector have stopped,
+// flushing the last scrape's spans before exiting
+func shutdown(ctx context.Context, stopTracing func(context.Context) error) {
+	deletePushgateway()
+	if err := stopTracing(ctx); err != nil {
+		slog.Warn("Failed to flush trace spans", "err", err)
 	}
+	slog.Info("Stopped gpustat-exporter")
 }
@@ -0,0 +1,913 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMain(m *testing.M) {
+	initMetrics()
+	os.Exit(m.Run())
+}
+
+// readFixture returns the contents of a file in testdata
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	return string(data)
+}
+
+// setFlag sets a flag value for the duration of a test
+func setFlag[T any](t testing.TB, target *T, value T) {
+	t.Helper()
+	previous := *target
+	*target = value
+	t.Cleanup(func() { *target = previous })
+}
+
+// collectOutput runs collectMetrics on gpustat output saved to a temporary
+// input file
+func collectOutput(t *testing.T, output string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gpustat.txt")
+	if err := os.WriteFile(path, []byte(output), 0o644); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+	setFlag(t, gpustatInputFile, path)
+	if err := collectMetrics(); err != nil {
+		t.Fatalf("collectMetrics() error = %v", err)
+	}
+}
+
+// floatPtr returns a pointer to v for the optional GPUInfo fields
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// formatOptional formats an optional value for test failures
+func formatOptional(v *float64) any {
+	if v == nil {
+		return "nil"
+	}
+	return *v
+}
+
+// equalFloats reports whether two value lists are equal
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// seriesValues returns the values of the collector's series carrying all of
+// the given labels
+func seriesValues(t *testing.T, c prometheus.Collector, labels map[string]string) []float64 {
+	t.Helper()
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var values []float64
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatalf("failed to write metric: %v", err)
+		}
+
+		matched := 0
+		for _, pair := range m.GetLabel() {
+			if value, ok := labels[pair.GetName()]; ok && value == pair.GetValue() {
+				matched++
+			}
+		}
+		if matched != len(labels) {
+			continue
+		}
+
+		switch {
+		case m.Gauge != nil:
+			values = append(values, m.GetGauge().GetValue())
+		case m.Counter != nil:
+			values = append(values, m.GetCounter().GetValue())
+		}
+	}
+	return values
+}
+
+func TestParseGPUStatOutputDecimalSeparator(t *testing.T) {
+	tests := []struct {
+		separator  string
+		wantTemp   *float64
+		wantUtil   *float64
+		zeroValued []string
+	}{
+		// With the default separator the comma values can't be parsed and
+		// must not be reported as 0
+		{".", nil, nil, []string{"temperature", "utilization"}},
+		{",", floatPtr(48.5), floatPtr(12.5), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.separator, func(t *testing.T) {
+			setFlag(t, decimalSeparator, tt.separator)
+
+			hosts, err := parseGPUStatOutput(readFixture(t, "decimal_comma.txt"))
+			if err != nil {
+				t.Fatalf("parseGPUStatOutput() error = %v", err)
+			}
+			if len(hosts) != 1 || len(hosts[0].GPUs) != 2 {
+				t.Fatalf("parsed %d hosts, want 1 host with 2 GPUs", len(hosts))
+			}
+
+			gpu := hosts[0].GPUs[0]
+			if !reflect.DeepEqual(gpu.Temperature, tt.wantTemp) {
+				t.Errorf("Temperature = %v, want %v", formatOptional(gpu.Temperature), formatOptional(tt.wantTemp))
+			}
+			if !reflect.DeepEqual(gpu.Utilization, tt.wantUtil) {
+				t.Errorf("Utilization = %v, want %v", formatOptional(gpu.Utilization), formatOptional(tt.wantUtil))
+			}
+			if !reflect.DeepEqual(gpu.MemoryUsed, floatPtr(512)) {
+				t.Errorf("MemoryUsed = %v, want 512", formatOptional(gpu.MemoryUsed))
+			}
+			if !reflect.DeepEqual(hosts[0].zeroValued, tt.zeroValued) {
+				t.Errorf("zeroValued = %v, want %v", hosts[0].zeroValued, tt.zeroValued)
+			}
+
+			// Integer values parse with either separator
+			if other := hosts[0].GPUs[1]; !reflect.DeepEqual(other.Temperature, floatPtr(51)) {
+				t.Errorf("GPU 1 Temperature = %v, want 51", formatOptional(other.Temperature))
+			}
+		})
+	}
+}
+
+func TestTemperatureLimit(t *testing.T) {
+	// Unknown models are skipped with a default limit of 0
+	setFlag(t, defaultTempLimit, 0)
+
+	tests := []struct {
+		name string
+		want float64
+	}{
+		{"NVIDIA A100-SXM4-80GB", 85},
+		{"NVIDIA A100 80GB PCIe", 85},
+		{"NVIDIA H100 80GB HBM3", 90},
+		{"Tesla V100-PCIE-32GB", 83},
+		{"Tesla T4", 85},
+		{"NVIDIA RTX A1000", 0},
+		{"NVIDIA T400", 0},
+		{"Quadro T4000", 0},
+		{"NVIDIA GeForce RTX 4090", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := temperatureLimit(tt.name); got != tt.want {
+				t.Errorf("temperatureLimit(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectMetricsForgetsUserAverages(t *testing.T) {
+	t.Cleanup(initMetrics)
+	setFlag(t, userEMAAlpha, 0.5)
+	initMetrics()
+	userMemoryEMA = make(map[hostUser]float64)
+
+	collectOutput(t, `gpu-node-01                  Wed Oct 15 12:00:00 2025  535.104.05
+[0] NVIDIA A100-SXM4-80GB | 45°C,  90 % |  3000 / 81920 MB | alice(1000M) bob(2000M)
+`)
+	collectOutput(t, `gpu-node-01                  Wed Oct 15 12:00:15 2025  535.104.05
+[0] NVIDIA A100-SXM4-80GB | 45°C,  90 % |  1000 / 81920 MB | alice(1000M)
+`)
+
+	if _, ok := userMemoryEMA[hostUser{"gpu-node-01", "", "alice"}]; !ok {
+		t.Error("average of alice forgotten while alice still has processes")
+	}
+	if _, ok := userMemoryEMA[hostUser{"gpu-node-01", "", "bob"}]; ok {
+		t.Error("average of bob kept after the processes of bob exited")
+	}
+}
+
+func TestCollectMetricsForgetsMemoryHistory(t *testing.T) {
+	setFlag(t, slopeWindow, time.Hour)
+	memoryHistory = make(map[string][]memorySample)
+
+	collectOutput(t, `gpu-node-01                  Wed Oct 15 12:00:00 2025  535.104.05
+[0] NVIDIA A100-SXM4-80GB | 45°C,  90 % |  3000 / 81920 MB | alice(3000M)
+[1] NVIDIA A100-SXM4-80GB | 45°C,  90 % |  1000 / 81920 MB | bob(1000M)
+`)
+	collectOutput(t, `gpu-node-02                  Wed Oct 15 12:00:15 2025  535.104.05
+[0] NVIDIA A100-SXM4-80GB | 45°C,  90 % |  2000 / 81920 MB | carol(2000M)
+`)
+
+	want := []string{"gpu-node-02||0"}
+	var got []string
+	for key := range memoryHistory {
+		got = append(got, key)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("memory history keys = %v, want %v", got, want)
+	}
+}
+
+// syntheticOutput returns gpustat --show-cmd --show-pid output for a host with
+// the given number of GPUs, each running the given number of processes
+func syntheticOutput(gpus, processes int) string {
+	var b strings.Builder
+	b.WriteString("dgx-node-01                  Wed Oct 15 12:00:00 2025  535.104.05\n")
+	for i := 0; i < gpus; i++ {
+		fmt.Fprintf(&b, "[%d] NVIDIA A100-SXM4-80GB | 45°C,  90 %% | %5d / 81920 MB |", i, processes*512)
+		for j := 0; j < processes; j++ {
+			fmt.Fprintf(&b, " user%02d:python/%d(512M)", j%8, 10000+i*processes+j)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func BenchmarkParseGPUStatOutput(b *testing.B) {
+	output := syntheticOutput(16, 32)
+	b.SetBytes(int64(len(output)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseGPUStatOutput(output); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCollectMetrics(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "gpustat.txt")
+	if err := os.WriteFile(path, []byte(syntheticOutput(16, 32)), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(initMetrics)
+	setFlag(b, gpustatInputFile, path)
+	setFlag(b, showCmd, true)
+	setFlag(b, showPid, true)
+	initMetrics()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := collectMetrics(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCollectMetricsDeletesSeriesWithPipeInName(t *testing.T) {
+	t.Cleanup(initMetrics)
+	setFlag(t, gpustatJSONOutput, true)
+	initMetrics()
+
+	output := func(processes string) string {
+		return `{"hostname": "gpu-node-01", "driver_version": "535.104.05", "gpus": [{
+			"index": 0, "uuid": "GPU-5d5c3d4e", "name": "ACME|Accel 9000",
+			"temperature.gpu": 45, "utilization.gpu": 90, "memory.used": 1000, "memory.total": 81920,
+			"processes": [` + processes + `]
+		}]}`
+	}
+	labels := map[string]string{"gpu_name": "ACME|Accel 9000", "username": "alice"}
+
+	collectOutput(t, output(`{"username": "alice", "command": "python", "pid": 1234, "gpu_memory_usage": 1000}`))
+	if got := seriesValues(t, gpuUserMemory, labels); !equalFloats(got, []float64{1000}) {
+		t.Fatalf("user memory series = %v, want [1000]", got)
+	}
+	if got := seriesValues(t, gpuProcessMemory, labels); !equalFloats(got, []float64{1000}) {
+		t.Fatalf("process memory series = %v, want [1000]", got)
+	}
+
+	collectOutput(t, output(""))
+	if got := seriesValues(t, gpuUserMemory, labels); len(got) != 0 {
+		t.Errorf("stale user memory series = %v, want none", got)
+	}
+	if got := seriesValues(t, gpuProcessMemory, labels); len(got) != 0 {
+		t.Errorf("stale process memory series = %v, want none", got)
+	}
+}
+
+func TestTrackedSeriesKeys(t *testing.T) {
+	names := []string{"gpu_name", "username"}
+	series := make(trackedSeries)
+	series.track(names, prometheus.Labels{"gpu_name": "ACME|Accel", "username": "alice"})
+	series.track(names, prometheus.Labels{"gpu_name": "ACME", "username": "Accel|alice"})
+
+	// A pipe-joined key would merge these two series
+	if len(series) != 2 {
+		t.Fatalf("tracked %d series, want 2", len(series))
+	}
+	for _, values := range series {
+		if len(values) != len(names) {
+			t.Errorf("tracked values %q, want %d values", values, len(names))
+		}
+	}
+}
+
+// TestCollectMetricsPerGPUConcurrency builds a dense node's metrics with and
+// without per-GPU goroutines; run with -race to check the shared state
+func TestCollectMetricsPerGPUConcurrency(t *testing.T) {
+	setFlag(t, slopeWindow, time.Hour)
+	setFlag(t, userEMAAlpha, 0.5)
+
+	collectors := map[string]prometheus.Collector{
+		"temperature":          gpuTemperature,
+		"temperature headroom": gpuTempHeadroom,
+		"user memory":          gpuUserMemory,
+		"user memory total":    userMemoryTotal,
+		"process count":        gpuProcessCount,
+		"max process memory":   gpuMaxProcessMemory,
+	}
+	collect := func(concurrency int) map[string][]float64 {
+		setFlag(t, perGPUConcurrency, concurrency)
+		collectOutput(t, readFixture(t, "dgx.txt"))
+
+		values := make(map[string][]float64, len(collectors))
+		for name, c := range collectors {
+			series := seriesValues(t, c, map[string]string{"hostname": "dgx-node-01"})
+			sort.Float64s(series)
+			values[name] = series
+		}
+		return values
+	}
+
+	want := collect(1)
+	if len(want["temperature"]) != 8 {
+		t.Fatalf("collected %d temperature series, want 8", len(want["temperature"]))
+	}
+	for _, concurrency := range []int{4, 16} {
+		if got := collect(concurrency); !reflect.DeepEqual(got, want) {
+			t.Errorf("concurrency %d collected %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+func TestCollectMetricsDuplicatePID(t *testing.T) {
+	tests := []struct {
+		name      string
+		showPid   bool
+		processes string
+		want      float64
+	}{
+		{"duplicated pid", true, "alice/1234(1000M) alice/1234(1000M) alice/1235(500M)", 1500},
+		// Without pids the entries can't be told apart from two processes
+		{"no pids", false, "alice(1000M) alice(1000M) alice(500M)", 2500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(initMetrics)
+			setFlag(t, showPid, tt.showPid)
+			initMetrics()
+
+			collectOutput(t, "gpu-node-01                  Wed Oct 15 12:00:00 2025  535.104.05\n"+
+				"[0] NVIDIA A100-SXM4-80GB | 45°C,  90 % |  2500 / 81920 MB | "+tt.processes+"\n")
+
+			labels := map[string]string{"hostname": "gpu-node-01", "username": "alice"}
+			if got := seriesValues(t, gpuUserMemory, labels); !equalFloats(got, []float64{tt.want}) {
+				t.Errorf("user memory = %v, want [%v]", got, tt.want)
+			}
+			if got := seriesValues(t, userMemoryTotal, labels); !equalFloats(got, []float64{tt.want}) {
+				t.Errorf("user memory total = %v, want [%v]", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGPUStatOutputFahrenheit(t *testing.T) {
+	hosts, err := parseGPUStatOutput(readFixture(t, "fahrenheit.txt"))
+	if err != nil {
+		t.Fatalf("parseGPUStatOutput() error = %v", err)
+	}
+
+	want := []float64{48.888888888888886, 80, 35}
+	var got []float64
+	for _, gpu := range hosts[0].GPUs {
+		if gpu.Temperature == nil {
+			t.Fatalf("GPU %s has no temperature", gpu.Index)
+		}
+		got = append(got, *gpu.Temperature)
+	}
+	if !equalFloats(got, want) {
+		t.Errorf("temperatures = %v, want %v in Celsius", got, want)
+	}
+}
+
+func TestParseGPULineMemoryUnits(t *testing.T) {
+	tests := []struct {
+		memory    string
+		wantUsed  float64
+		wantTotal float64
+	}{
+		{"1871 / 97887 MB", 1871, 97887},
+		{"1871 / 97887 MiB", 1871, 97887},
+		{"1.5 / 80 GiB", 1536, 81920},
+		{"1.5 / 80 GB", 1500, 80000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.memory, func(t *testing.T) {
+			gpu, zeroValued, err := parseGPULine("[0] NVIDIA A100-SXM4-80GB | 45°C,  90 % | " + tt.memory + " |")
+			if err != nil {
+				t.Fatalf("parseGPULine() error = %v", err)
+			}
+			if len(zeroValued) != 0 {
+				t.Errorf("zeroValued = %v, want none", zeroValued)
+			}
+			if !reflect.DeepEqual(gpu.MemoryUsed, floatPtr(tt.wantUsed)) {
+				t.Errorf("MemoryUsed = %v, want %v", formatOptional(gpu.MemoryUsed), tt.wantUsed)
+			}
+			if !reflect.DeepEqual(gpu.MemoryTotal, floatPtr(tt.wantTotal)) {
+				t.Errorf("MemoryTotal = %v, want %v", formatOptional(gpu.MemoryTotal), tt.wantTotal)
+			}
+		})
+	}
+}
+
+// fakeGPUStat points --gpustat.path at a shell script for the test
+func fakeGPUStat(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake gpustat is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "gpustat")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatalf("failed to write fake gpustat: %v", err)
+	}
+	setFlag(t, gpustatPath, path)
+}
+
+func TestCollectMetricsGPUStatStderr(t *testing.T) {
+	tests := []struct {
+		name        string
+		exitCode    int
+		wantErr     string
+		wantSuccess float64
+	}{
+		// Benign warnings must not fail the scrape
+		{"warning on success", 0, "", 1},
+		{"failure", 1, "NVML Shared Library Not Found", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeGPUStat(t, fmt.Sprintf(`echo 'gpu-node-01                  Wed Oct 15 12:00:00 2025  535.104.05'
+echo '[0] NVIDIA A100-SXM4-80GB | 45°C,  90 %% |  1000 / 81920 MB | alice(1000M)'
+echo 'NVML Shared Library Not Found' >&2
+exit %d
+`, tt.exitCode))
+
+			err := collectMetrics()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("collectMetrics() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("collectMetrics() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			if got := seriesValues(t, scrapeSuccess, nil); !equalFloats(got, []float64{tt.wantSuccess}) {
+				t.Errorf("scrape_success = %v, want [%v]", got, tt.wantSuccess)
+			}
+		})
+	}
+}
+
+func TestParseGPUStatOutputShowAll(t *testing.T) {
+	tests := []struct {
+		fixture string
+		name    string
+	}{
+		{"show_all_0.6.txt", "GeForce RTX 2080 Ti"},
+		// 1.x adds the encoder/decoder utilization to the section
+		{"show_all_1.1.txt", "NVIDIA A100-SXM4-80GB"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			hosts, err := parseGPUStatOutput(readFixture(t, tt.fixture))
+			if err != nil {
+				t.Fatalf("parseGPUStatOutput() error = %v", err)
+			}
+			if len(hosts) != 1 || len(hosts[0].GPUs) != 2 {
+				t.Fatalf("parsed %d hosts, want 1 host with 2 GPUs", len(hosts))
+			}
+			if len(hosts[0].zeroValued) != 0 {
+				t.Errorf("zeroValued = %v, want none", hosts[0].zeroValued)
+			}
+
+			gpu := hosts[0].GPUs[0]
+			if gpu.Name != tt.name {
+				t.Errorf("Name = %q, want %q", gpu.Name, tt.name)
+			}
+			for field, v := range map[string]struct{ got, want *float64 }{
+				"Temperature": {gpu.Temperature, floatPtr(67)},
+				"FanSpeed":    {gpu.FanSpeed, floatPtr(54)},
+				"Utilization": {gpu.Utilization, floatPtr(97)},
+				"PowerDraw":   {gpu.PowerDraw, floatPtr(231)},
+				"MemoryUsed":  {gpu.MemoryUsed, floatPtr(10455)},
+			} {
+				if !reflect.DeepEqual(v.got, v.want) {
+					t.Errorf("%s = %v, want %v", field, formatOptional(v.got), formatOptional(v.want))
+				}
+			}
+
+			want := []ProcessInfo{{Username: "alice", Command: "python", PID: "31337", Memory: 10443}}
+			if !reflect.DeepEqual(gpu.Processes, want) {
+				t.Errorf("Processes = %+v, want %+v", gpu.Processes, want)
+			}
+			if idle := hosts[0].GPUs[1]; len(idle.Processes) != 0 || !reflect.DeepEqual(idle.Utilization, floatPtr(0)) {
+				t.Errorf("idle GPU = %+v, want no processes and 0 utilization", idle)
+			}
+		})
+	}
+}
+
+func TestParseGPUStatOutputColumnOrders(t *testing.T) {
+	hosts, err := parseGPUStatOutput(readFixture(t, "column_orders.txt"))
+	if err != nil {
+		t.Fatalf("parseGPUStatOutput() error = %v", err)
+	}
+	if len(hosts[0].GPUs) != 4 {
+		t.Fatalf("parsed %d GPUs, want 4", len(hosts[0].GPUs))
+	}
+	if len(hosts[0].zeroValued) != 0 {
+		t.Errorf("zeroValued = %v, want none", hosts[0].zeroValued)
+	}
+
+	power := map[string]*float64{"0": floatPtr(250), "2": floatPtr(250)}
+	fan := map[string]*float64{"2": floatPtr(30)}
+	for _, gpu := range hosts[0].GPUs {
+		for field, v := range map[string]struct{ got, want *float64 }{
+			"Temperature": {gpu.Temperature, floatPtr(45)},
+			"Utilization": {gpu.Utilization, floatPtr(90)},
+			"MemoryUsed":  {gpu.MemoryUsed, floatPtr(3000)},
+			"MemoryTotal": {gpu.MemoryTotal, floatPtr(81920)},
+			"PowerDraw":   {gpu.PowerDraw, power[gpu.Index]},
+			"FanSpeed":    {gpu.FanSpeed, fan[gpu.Index]},
+		} {
+			if !reflect.DeepEqual(v.got, v.want) {
+				t.Errorf("GPU %s %s = %v, want %v", gpu.Index, field, formatOptional(v.got), formatOptional(v.want))
+			}
+		}
+		if len(gpu.Processes) != 1 || gpu.Processes[0].Memory != 3000 {
+			t.Errorf("GPU %s Processes = %+v, want alice with 3000M", gpu.Index, gpu.Processes)
+		}
+	}
+}
+
+func TestParseGPULineZeroValuedSections(t *testing.T) {
+	tests := []struct {
+		name       string
+		sections   string
+		zeroValued []string
+		wantErr    bool
+	}{
+		{"all parsed", "45°C,  90 % |  250 / 400 W |  3000 / 81920 MB | alice(3000M)", nil, false},
+		{"unknown sections ignored", "P0 | 45°C,  90 % | MIG disabled |  3000 / 81920 MB", nil, false},
+		{"temperature", "??°C,  90 % |  3000 / 81920 MB", []string{"temperature"}, false},
+		{"power", "45°C,  90 % |  ?? W |  3000 / 81920 MB", []string{"power"}, false},
+		{"memory", "45°C,  90 % |  ?? / 81920 MB", []string{"memory"}, false},
+		{"processes", "45°C,  90 % |  3000 / 81920 MB | (3000M)", []string{"processes"}, false},
+		{"nothing recognized", "P0 | MIG disabled", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, zeroValued, err := parseGPULine("[0] NVIDIA A100-SXM4-80GB | " + tt.sections)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseGPULine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(zeroValued, tt.zeroValued) {
+				t.Errorf("zeroValued = %v, want %v", zeroValued, tt.zeroValued)
+			}
+		})
+	}
+}
+
+func TestParseGPUStatOutputMultiHost(t *testing.T) {
+	hosts, err := parseGPUStatOutput(readFixture(t, "multi_host.txt"))
+	if err != nil {
+		t.Fatalf("parseGPUStatOutput() error = %v", err)
+	}
+
+	want := []struct {
+		hostname string
+		driver   string
+		gpus     []string
+	}{
+		{"gpu-node-01", "535.104.05", []string{"NVIDIA A100-SXM4-80GB", "NVIDIA A100-SXM4-80GB"}},
+		{"gpu-node-02", "550.54.15", []string{"NVIDIA H100 80GB HBM3"}},
+		{"gpu-node-03", "550.54.15", []string{"NVIDIA H100 80GB HBM3"}},
+	}
+	if len(hosts) != len(want) {
+		t.Fatalf("parsed %d hosts, want %d", len(hosts), len(want))
+	}
+	for i, w := range want {
+		var names []string
+		for _, gpu := range hosts[i].GPUs {
+			names = append(names, gpu.Name)
+		}
+		if hosts[i].Hostname != w.hostname || hosts[i].DriverVersion != w.driver || !reflect.DeepEqual(names, w.gpus) {
+			t.Errorf("host %d = %s %s %q, want %s %s %q", i, hosts[i].Hostname, hosts[i].DriverVersion, names, w.hostname, w.driver, w.gpus)
+		}
+	}
+}
+
+func TestParseGPUStatOutputNoHeader(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skipf("hostname unknown: %v", err)
+	}
+
+	hosts, err := parseGPUStatOutput(readFixture(t, "no_header.txt"))
+	if err != nil {
+		t.Fatalf("parseGPUStatOutput() error = %v", err)
+	}
+	if len(hosts) != 1 {
+		t.Fatalf("parsed %d hosts, want 1", len(hosts))
+	}
+	if hosts[0].Hostname != hostname {
+		t.Errorf("Hostname = %q, want the local %q", hosts[0].Hostname, hostname)
+	}
+	// GPU 0 must not be taken for a header
+	if len(hosts[0].GPUs) != 2 || hosts[0].GPUs[0].Index != "0" {
+		t.Errorf("GPUs = %+v, want GPUs 0 and 1", hosts[0].GPUs)
+	}
+	if hosts[0].DriverVersion != "" || !hosts[0].Timestamp.IsZero() {
+		t.Errorf("driver %q and timestamp %v, want neither", hosts[0].DriverVersion, hosts[0].Timestamp)
+	}
+}
+
+func TestParseGPULineDegreeMarkers(t *testing.T) {
+	tests := []struct {
+		name   string
+		marker string
+	}{
+		{"degree sign", "°C"},
+		{"apostrophe", "'C"},
+		{"celsius sign", "℃"},
+		{"ordinal indicator", "ºC"},
+		{"ring above", "˚C"},
+		{"modifier letter o", "ᵒC"},
+		{"mis-decoded UTF-8", "Â°C"},
+		{"Latin-1 byte", "\xb0C"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gpu, zeroValued, err := parseGPULine("[0] NVIDIA A100-SXM4-80GB | 45" + tt.marker + ",  90 % |  3000 / 81920 MB |")
+			if err != nil {
+				t.Fatalf("parseGPULine() error = %v", err)
+			}
+			if len(zeroValued) != 0 {
+				t.Errorf("zeroValued = %v, want none", zeroValued)
+			}
+			if !reflect.DeepEqual(gpu.Temperature, floatPtr(45)) {
+				t.Errorf("Temperature = %v, want 45", formatOptional(gpu.Temperature))
+			}
+			if !reflect.DeepEqual(gpu.Utilization, floatPtr(90)) {
+				t.Errorf("Utilization = %v, want 90", formatOptional(gpu.Utilization))
+			}
+		})
+	}
+}
+
+func TestExcludeSelfProcesses(t *testing.T) {
+	if _, err := os.Stat("/proc/self/status"); err != nil {
+		t.Skip("parent pids are read from /proc")
+	}
+
+	// A renamed gpustat run by the exporter, only recognizable by its parent
+	child := exec.Command("sleep", "10")
+	if err := child.Start(); err != nil {
+		t.Fatalf("failed to start child process: %v", err)
+	}
+	t.Cleanup(func() {
+		child.Process.Kill()
+		child.Wait()
+	})
+	fixture := strings.NewReplacer(
+		"{self}", strconv.Itoa(os.Getpid()),
+		"{child}", strconv.Itoa(child.Process.Pid),
+	).Replace(readFixture(t, "exclude_self.txt"))
+
+	tests := []struct {
+		name     string
+		command  string
+		matchPID bool
+		want     [][]string
+	}{
+		// Matched on the base name, so a full path is dropped but a
+		// command that only starts with the name is kept
+		{"command", "gpustat", false, [][]string{{"python", "gpustat-v2", "gpustat-wrapper"}, {"gpustat-exporter"}}},
+		{"pid", "", true, [][]string{{"python", "gpustat-wrapper"}, {"/opt/tools/gpustat"}}},
+		{"command and pid", "gpustat", true, [][]string{{"python", "gpustat-wrapper"}, nil}},
+		// Pids from other hosts or namespaces are never compared
+		{"neither", "", false, [][]string{{"python", "gpustat-v2", "gpustat-wrapper"}, {"/opt/tools/gpustat", "gpustat-exporter"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, excludeSelfCommand, tt.command)
+
+			hosts, err := parseGPUStatOutput(fixture)
+			if err != nil {
+				t.Fatalf("parseGPUStatOutput() error = %v", err)
+			}
+			excludeSelfProcesses(hosts[0].GPUs, tt.matchPID)
+
+			var got [][]string
+			for _, gpu := range hosts[0].GPUs {
+				var commands []string
+				for _, proc := range gpu.Processes {
+					commands = append(commands, proc.Command)
+				}
+				got = append(got, commands)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept commands = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketMemory(t *testing.T) {
+	tests := []struct {
+		memory float64
+		bucket float64
+		want   float64
+	}{
+		{1023, 0, 1023},
+		{1023, -1024, 1023},
+		{0, 1024, 0},
+		{1023, 1024, 0},
+		{1024, 1024, 1024},
+		{1025, 1024, 1024},
+		{2047.5, 1024, 1024},
+		{2048, 1024, 2048},
+	}
+
+	for _, tt := range tests {
+		if got := bucketMemory(tt.memory, tt.bucket); got != tt.want {
+			t.Errorf("bucketMemory(%v, %v) = %v, want %v", tt.memory, tt.bucket, got, tt.want)
+		}
+	}
+}
+
+func TestCollectMetricsUserMemoryBucket(t *testing.T) {
+	setFlag(t, userMemoryBucket, 1024)
+	collectOutput(t, readFixture(t, "bucket_boundaries.txt"))
+
+	tests := []struct {
+		username  string
+		wantGPU   float64
+		wantTotal float64
+	}{
+		{"alice", 0, 1023},
+		{"bob", 1024, 1024},
+		{"carol", 3072, 3072},
+	}
+
+	for _, tt := range tests {
+		labels := map[string]string{"hostname": "gpu-node-01", "username": tt.username}
+		if got := seriesValues(t, gpuUserMemory, labels); !equalFloats(got, []float64{tt.wantGPU}) {
+			t.Errorf("%s user memory = %v, want [%v]", tt.username, got, tt.wantGPU)
+		}
+		// Host totals stay exact
+		if got := seriesValues(t, userMemoryTotal, labels); !equalFloats(got, []float64{tt.wantTotal}) {
+			t.Errorf("%s user memory total = %v, want [%v]", tt.username, got, tt.wantTotal)
+		}
+	}
+}
+
+func TestParseGPUStatOutputWindowsLineEndings(t *testing.T) {
+	// A byte order mark, CRLF endings and a doubled "\r\r\n" from a console pipe
+	hosts, err := parseGPUStatOutput(readFixture(t, "crlf.txt"))
+	if err != nil {
+		t.Fatalf("parseGPUStatOutput() error = %v", err)
+	}
+	if len(hosts) != 1 {
+		t.Fatalf("parsed %d hosts, want 1", len(hosts))
+	}
+
+	if hosts[0].Hostname != "win-render-01" || hosts[0].DriverVersion != "537.58" {
+		t.Errorf("header = %q %q, want win-render-01 537.58", hosts[0].Hostname, hosts[0].DriverVersion)
+	}
+	if len(hosts[0].GPUs) != 2 {
+		t.Fatalf("parsed %d GPUs, want 2", len(hosts[0].GPUs))
+	}
+	want := []ProcessInfo{{Username: "alice", Memory: 3000}}
+	if got := hosts[0].GPUs[0].Processes; !reflect.DeepEqual(got, want) {
+		t.Errorf("Processes = %+v, want %+v", got, want)
+	}
+	if len(hosts[0].zeroValued) != 0 {
+		t.Errorf("zeroValued = %v, want none", hosts[0].zeroValued)
+	}
+}
+
+func TestCollectMetricsGPUStatTimeout(t *testing.T) {
+	// The sleep child keeps stdout open after the shell is killed, which
+	// WaitDelay bounds
+	fakeGPUStat(t, "sleep 10\n")
+	setFlag(t, gpustatTimeout, 100*time.Millisecond)
+	scrapeSuccess.Set(1)
+
+	start := time.Now()
+	err := collectMetrics()
+	elapsed := time.Since(start)
+
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Errorf("collectMetrics() error = %v, want a timeout", err)
+	}
+	if got := seriesValues(t, scrapeSuccess, nil); !equalFloats(got, []float64{0}) {
+		t.Errorf("scrape_success = %v, want [0]", got)
+	}
+	// Timeout plus the one second WaitDelay, with slack for a loaded machine
+	if limit := *gpustatTimeout + time.Second + 500*time.Millisecond; elapsed > limit {
+		t.Errorf("collectMetrics() returned after %s, want within %s", elapsed, limit)
+	}
+}
+
+func TestCollectMetricsMultiGPUProcesses(t *testing.T) {
+	t.Cleanup(initMetrics)
+	setFlag(t, showPid, true)
+	initMetrics()
+
+	// 4100 spans three GPUs and 4200 two; 4201 and 4300 use one each
+	collectOutput(t, readFixture(t, "multigpu.txt"))
+	if got := seriesValues(t, multiGPUProcesses, map[string]string{"hostname": "dgx-node-01"}); !equalFloats(got, []float64{2}) {
+		t.Errorf("multigpu_process_count = %v, want [2]", got)
+	}
+}
+
+func TestScrapeConfig(t *testing.T) {
+	setFlag(t, scrapeInterval, 30*time.Second)
+	setFlag(t, metricsPath, "/metrics")
+	setFlag(t, tlsCertFile, "")
+	setFlag(t, authUsername, "prometheus")
+
+	// A Host header trying to break out of the quoted target
+	host := "gpu-node-01:9101']\n  - job_name: 'evil"
+	config, err := scrapeConfig(host)
+	if err != nil {
+		t.Fatalf("scrapeConfig() error = %v", err)
+	}
+
+	var parsed struct {
+		ScrapeConfigs []promScrapeConfig `yaml:"scrape_configs"`
+	}
+	if err := yaml.Unmarshal([]byte(config), &parsed); err != nil {
+		t.Fatalf("scrapeConfig() returned invalid YAML: %v\n%s", err, config)
+	}
+	if len(parsed.ScrapeConfigs) != 1 {
+		t.Fatalf("scrapeConfig() = %d scrape configs, want 1:\n%s", len(parsed.ScrapeConfigs), config)
+	}
+	got := parsed.ScrapeConfigs[0]
+	if len(got.StaticConfigs) != 1 || !reflect.DeepEqual(got.StaticConfigs[0].Targets, []string{host}) {
+		t.Errorf("static_configs = %+v, want the Host header as the only target", got.StaticConfigs)
+	}
+	if got.BasicAuth == nil || got.BasicAuth.Username != "prometheus" {
+		t.Errorf("basic_auth = %+v, want username prometheus", got.BasicAuth)
+	}
+}
+
+func TestParseUtilizationBandsDefault(t *testing.T) {
+	bands, err := parseUtilizationBands(flag.Lookup("metrics.utilization-bands").DefValue)
+	if err != nil {
+		t.Fatalf("parseUtilizationBands() error = %v", err)
+	}
+
+	var names []string
+	for _, band := range bands {
+		names = append(names, band.Name)
+	}
+	if want := []string{"0", "1-25", "26-75", "76-100"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("default bands = %q, want %q", names, want)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// netnsNames returns the namespaces listed in --netns
+func netnsNames() []string {
+	var names []string
+	for _, name := range strings.Split(*netns, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// validateNamespaces checks that every --netns entry names a process or a
+// namespace directory. Only the network namespace is bound under /run/netns,
+// but gpustat needs the PID and mount namespaces to see the processes.
+func validateNamespaces() error {
+	for _, name := range netnsNames() {
+		if _, err := strconv.Atoi(name); err != nil && !filepath.IsAbs(name) {
+			return fmt.Errorf("%q must be a process ID or a namespace directory such as /proc/<pid>/ns", name)
+		}
+	}
+	return nil
+}
+
+// nsenterCommand returns the command line that runs gpustat inside the
+// network, PID and mount namespaces of a process ID, or of a directory holding
+// net, pid and mnt namespace files such as /proc/<pid>/ns. A path to the net
+// file itself is accepted for its directory.
+func nsenterCommand(name string) []string {
+	var args []string
+	if _, err := strconv.Atoi(name); err == nil {
+		args = []string{"nsenter", "--target=" + name, "--net", "--pid", "--mount", "--"}
+	} else {
+		dir := name
+		if filepath.Base(dir) == "net" {
+			dir = filepath.Dir(dir)
+		}
+		args = []string{"nsenter",
+			"--net=" + filepath.Join(dir, "net"),
+			"--pid=" + filepath.Join(dir, "pid"),
+			"--mount=" + filepath.Join(dir, "mnt"),
+			"--"}
+	}
+	return append(args, gpustatCommand()...)
+}
+
+// nsenterError turns a failed gpustat run inside a namespace into a clear error,
+// calling out the privileges nsenter needs
+func nsenterError(name string, err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		stderr := strings.TrimSpace(string(exitErr.Stderr))
+		if strings.HasPrefix(stderr, "nsenter:") {
+			if strings.Contains(stderr, "Operation not permitted") || strings.Contains(stderr, "Permission denied") {
+				return fmt.Errorf("permission denied entering namespace %q, run the exporter as root or with CAP_SYS_ADMIN, CAP_SYS_CHROOT and CAP_SYS_PTRACE: %s", name, stderr)
+			}
+			return fmt.Errorf("failed to enter namespace %q: %s", name, stderr)
+		}
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("nsenter not found, install util-linux to use --netns")
+	}
+	return fmt.Errorf("failed to execute gpustat in namespace %q: %w", name, err)
+}
+
+// collectNamespaces runs gpustat inside each --netns namespace with nsenter and
+// returns the parsed hosts, labelled by namespace. A namespace that
+// fails is logged and skipped so it doesn't fail the whole scrape.
+func collectNamespaces(ctx context.Context) []*GPUStatOutput {
+	ctx, span := tracer.Start(ctx, "netns")
+	defer span.End()
+
+	var hosts []*GPUStatOutput
+	for _, name := range netnsNames() {
+		parsed, err := runInNamespace(ctx, name)
+		if err != nil {
+			slog.Warn("Failed to scrape namespace", "namespace", name, "err", err)
+			span.SetStatus(codes.Error, err.Error())
+			continue
+		}
+
+		for _, stats := range parsed {
+			stats.Namespace = name
+			for i := range stats.GPUs {
+				stats.GPUs[i].Namespace = name
+			}
+		}
+		hosts = append(hosts, parsed...)
+	}
+	span.SetAttributes(attribute.Int("namespaces", len(netnsNames())))
+	return hosts
+}
+
+// runInNamespace runs and parses gpustat inside a single namespace
+func runInNamespace(ctx context.Context, name string) ([]*GPUStatOutput, error) {
+	command := nsenterCommand(name)
+	output, err := execGPUStat(ctx, command[0], command[1:]...)
+	if err != nil {
+		return nil, nsenterError(name, err)
+	}
+	outputBytes.WithLabelValues("", name).Set(float64(len(output)))
+
+	hosts, err := gpustatParser()(string(output))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse gpustat output from namespace %q: %w", name, err)
+	}
+	return hosts, nil
+}
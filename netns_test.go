@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNsenterCommand(t *testing.T) {
+	setFlag(t, gpustatPath, "gpustat")
+	setFlag(t, backend, "gpustat")
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"4711", []string{"nsenter", "--target=4711", "--net", "--pid", "--mount", "--", "gpustat"}},
+		{"/proc/4812/ns", []string{"nsenter", "--net=/proc/4812/ns/net", "--pid=/proc/4812/ns/pid", "--mount=/proc/4812/ns/mnt", "--", "gpustat"}},
+		{"/proc/4812/ns/net", []string{"nsenter", "--net=/proc/4812/ns/net", "--pid=/proc/4812/ns/pid", "--mount=/proc/4812/ns/mnt", "--", "gpustat"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nsenterCommand(tt.name); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nsenterCommand(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateNamespaces(t *testing.T) {
+	tests := []struct {
+		netns   string
+		wantErr bool
+	}{
+		{"", false},
+		{"4711,/proc/4812/ns", false},
+		// Named network namespaces have no PID or mount namespace
+		{"tenant-a", true},
+		{"4711,tenant-b", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.netns, func(t *testing.T) {
+			setFlag(t, netns, tt.netns)
+			if err := validateNamespaces(); (err != nil) != tt.wantErr {
+				t.Errorf("validateNamespaces() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestUpdateHostMetricsNamespaces checks that two namespaces scraped on the
+// same host keep their own per-host series and per-user state
+func TestUpdateHostMetricsNamespaces(t *testing.T) {
+	t.Cleanup(initMetrics)
+	setFlag(t, netns, "4711,4812")
+	setFlag(t, showCmd, true)
+	setFlag(t, userRefreshInterval, time.Hour)
+	setFlag(t, userEMAAlpha, 0.5)
+	initMetrics()
+
+	userProcessKeys = make(map[hostUser]trackedSeries)
+	userProcessRefreshed = make(map[hostUser]time.Time)
+	userMemoryEMA = make(map[hostUser]float64)
+
+	// Both namespaces see the same GPUs but only their own processes
+	namespaceOutput := func(namespace, username string) *GPUStatOutput {
+		stats := &GPUStatOutput{Hostname: "gpu-node-01", Namespace: namespace}
+		for _, gpu := range []GPUInfo{
+			{Index: "0", Name: "NVIDIA A100-SXM4-80GB", Utilization: floatPtr(90), Processes: []ProcessInfo{{Username: username, Command: "python", Memory: 1000}}},
+			{Index: "1", Name: "NVIDIA A100-SXM4-80GB", Utilization: floatPtr(0)},
+		} {
+			gpu.Namespace = namespace
+			stats.GPUs = append(stats.GPUs, gpu)
+		}
+		return stats
+	}
+	hosts := []*GPUStatOutput{namespaceOutput("4711", "alice"), namespaceOutput("4812", "bob")}
+
+	currentUserMemoryLabels := make(trackedSeries)
+	currentProcessMemoryLabels := make(trackedSeries)
+	currentUserTotalLabels := make(map[hostUser]bool)
+	for _, stats := range hosts {
+		updateHostMetrics(stats, currentUserMemoryLabels, currentProcessMemoryLabels, currentUserTotalLabels)
+	}
+
+	for _, ns := range []struct{ namespace, username string }{{"4711", "alice"}, {"4812", "bob"}} {
+		labels := map[string]string{"hostname": "gpu-node-01", "namespace": ns.namespace}
+		if got := seriesValues(t, gpusIdle, labels); !equalFloats(got, []float64{1}) {
+			t.Errorf("namespace %s gpus_idle = %v, want [1]", ns.namespace, got)
+		}
+		if got := seriesValues(t, gpusBusy, labels); !equalFloats(got, []float64{1}) {
+			t.Errorf("namespace %s gpus_busy = %v, want [1]", ns.namespace, got)
+		}
+		// Counted once per namespace rather than twice for the host
+		if got := seriesValues(t, processCountByCommand, labels); !equalFloats(got, []float64{1}) {
+			t.Errorf("namespace %s process_count_by_command = %v, want [1]", ns.namespace, got)
+		}
+
+		labels["username"] = ns.username
+		if got := seriesValues(t, userMemoryTotal, labels); !equalFloats(got, []float64{1000}) {
+			t.Errorf("namespace %s user_memory_total_megabytes = %v, want [1000]", ns.namespace, got)
+		}
+
+		key := hostUser{"gpu-node-01", ns.namespace, ns.username}
+		if !currentUserTotalLabels[key] {
+			t.Errorf("user total for %v not tracked", key)
+		}
+		// Scraping the other namespace must not forget this one's users
+		if _, ok := userProcessKeys[key]; !ok {
+			t.Errorf("process series of %v forgotten", key)
+		}
+		if userMemoryEMA[key] != 1000 {
+			t.Errorf("EMA of %v = %v, want 1000", key, userMemoryEMA[key])
+		}
+	}
+}
+
+func TestRunInNamespaceOutputBytes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake nsenter is a shell script")
+	}
+	output := "gpu-node-01  Wed Oct 15 12:00:00 2025  535.104.05\n" +
+		"[0] NVIDIA A100-SXM4-80GB | 45°C,  90 % |  1000 / 81920 MB |\n"
+	dir := t.TempDir()
+	script := "#!/bin/sh\nprintf '%s' '" + output + "'\n"
+	if err := os.WriteFile(filepath.Join(dir, "nsenter"), []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write fake nsenter: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	if _, err := runInNamespace(context.Background(), "4711"); err != nil {
+		t.Fatalf("runInNamespace() error = %v", err)
+	}
+	got := seriesValues(t, outputBytes, map[string]string{"host": "", "namespace": "4711"})
+	if !equalFloats(got, []float64{float64(len(output))}) {
+		t.Errorf("output_bytes = %v, want [%d]", got, len(output))
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wslNvidiaSmiPath is where WSL2 exposes the Windows driver's nvidia-smi, which
+// is not on PATH by default
+const wslNvidiaSmiPath = "/usr/lib/wsl/lib/nvidia-smi"
+
+// resolveNvidiaSmiPath falls back to the WSL2 location when the default
+// nvidia-smi is not found on PATH
+func resolveNvidiaSmiPath() {
+	if *nvidiaSmiPath != "nvidia-smi" {
+		return
+	}
+	if _, err := exec.LookPath(*nvidiaSmiPath); err == nil {
+		return
+	}
+	if _, err := os.Stat(wslNvidiaSmiPath); err == nil {
+		*nvidiaSmiPath = wslNvidiaSmiPath
+	}
+}
+
+// runNvidiaSmi runs nvidia-smi with the given arguments, shared by the field
+// queries and dmon. It is bounded by --gpustat.timeout, since a wedged driver
+// hangs nvidia-smi just like gpustat.
+func runNvidiaSmi(ctx context.Context, args ...string) ([]byte, error) {
+	cancel := func() {}
+	if *gpustatTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *gpustatTimeout)
+	}
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, *nvidiaSmiPath, args...)
+	cmd.WaitDelay = time.Second
+	output, err := cmd.Output()
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("nvidia-smi timed out after %s", *gpustatTimeout)
+	}
+	if err != nil {
+		// nvidia-smi explains query errors on stdout
+		var stderr []byte
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			stderr = exitErr.Stderr
+		}
+		if message := strings.TrimSpace(string(output) + " " + string(stderr)); message != "" {
+			return nil, fmt.Errorf("failed to execute nvidia-smi: %w: %s", err, message)
+		}
+		return nil, fmt.Errorf("failed to execute nvidia-smi: %w", err)
+	}
+	return output, nil
+}
+
+// invalidFieldRe matches nvidia-smi's error for a query field the driver
+// doesn't know, e.g. `Field "virtualization_mode" is not a valid field to query.`
+var invalidFieldRe = regexp.MustCompile(`Field "([^"]+)" is not a valid field to query`)
+
+// unsupportedNvidiaSmiFields are the fields the driver rejected, left out of
+// later queries
+var unsupportedNvidiaSmiFields = make(map[string]bool)
+
+// queryNvidiaSmi runs nvidia-smi for the given query fields and returns the
+// remaining field values of each row keyed by GPU index
+func queryNvidiaSmi(ctx context.Context, fields ...string) (map[string][]string, error) {
+	query := append([]string{"index"}, fields...)
+	output, err := runNvidiaSmi(ctx,
+		"--query-gpu="+strings.Join(query, ","),
+		"--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make(map[string][]string)
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		values := strings.Split(line, ",")
+		if len(values) != len(query) {
+			return nil, fmt.Errorf("unexpected nvidia-smi row %q: expected %d fields, got %d", line, len(query), len(values))
+		}
+		for i := range values {
+			values[i] = strings.TrimSpace(values[i])
+		}
+		rows[values[0]] = values[1:]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading nvidia-smi output: %w", err)
+	}
+
+	return rows, nil
+}
+
+// nvidiaSmiField describes an nvidia-smi query field and how its value is
+// merged into a GPU
+type nvidiaSmiField struct {
+	Name  string
+	Apply func(gpu *GPUInfo, value string)
+}
+
+// nvidiaSmiEnabled reports whether any enabled feature runs nvidia-smi
+func nvidiaSmiEnabled() bool {
+	return len(nvidiaSmiFields()) > 0 || *pcieThroughput || *collectProcessType
+}
+
+// nvidiaSmiFields returns the query fields required by the enabled features
+func nvidiaSmiFields() []nvidiaSmiField {
+	var fields []nvidiaSmiField
+
+	if *powerLimits {
+		fields = append(fields,
+			nvidiaSmiField{"power.default_limit", func(gpu *GPUInfo, value string) {
+				gpu.PowerDefaultLimit = parseOptionalFloat(value)
+			}},
+			nvidiaSmiField{"power.enforced_limit", func(gpu *GPUInfo, value string) {
+				gpu.PowerEnforcedLimit = parseOptionalFloat(value)
+			}},
+		)
+	}
+
+	if *bar1Memory {
+		fields = append(fields,
+			nvidiaSmiField{"bar1.memory.used", func(gpu *GPUInfo, value string) {
+				gpu.Bar1MemoryUsed = parseOptionalFloat(value)
+			}},
+			nvidiaSmiField{"bar1.memory.total", func(gpu *GPUInfo, value string) {
+				gpu.Bar1MemoryTotal = parseOptionalFloat(value)
+			}},
+		)
+	}
+
+	if *clockSpeeds {
+		fields = append(fields,
+			nvidiaSmiField{"clocks.gr", func(gpu *GPUInfo, value string) {
+				gpu.GraphicsClock = parseOptionalFloat(value)
+			}},
+		)
+	}
+
+	// The current memory clock is shared by the clock gauges and the ratio
+	if *clockSpeeds || *memoryClockRatio {
+		fields = append(fields,
+			nvidiaSmiField{"clocks.mem", func(gpu *GPUInfo, value string) {
+				gpu.MemoryClock = parseOptionalFloat(value)
+			}},
+		)
+	}
+
+	if *memoryClockRatio {
+		fields = append(fields,
+			nvidiaSmiField{"clocks.max.mem", func(gpu *GPUInfo, value string) {
+				gpu.MemoryClockMax = parseOptionalFloat(value)
+			}},
+		)
+	}
+
+	if *throttleReasons {
+		fields = append(fields,
+			nvidiaSmiField{"clocks_throttle_reasons.active", func(gpu *GPUInfo, value string) {
+				gpu.ThrottleReasons = parseThrottleReasons(value)
+			}},
+		)
+	}
+
+	if *collectECC {
+		fields = append(fields,
+			nvidiaSmiField{"ecc.errors.corrected.aggregate.total", func(gpu *GPUInfo, value string) {
+				gpu.ECCCorrected = parseOptionalFloat(value)
+			}},
+			nvidiaSmiField{"ecc.errors.uncorrected.aggregate.total", func(gpu *GPUInfo, value string) {
+				gpu.ECCUncorrected = parseOptionalFloat(value)
+			}},
+		)
+	}
+
+	if *collectPCIe {
+		fields = append(fields,
+			nvidiaSmiField{"pcie.link.gen.current", func(gpu *GPUInfo, value string) {
+				gpu.PCIeLinkGen = parseOptionalFloat(value)
+			}},
+			nvidiaSmiField{"pcie.link.width.current", func(gpu *GPUInfo, value string) {
+				gpu.PCIeLinkWidth = parseOptionalFloat(value)
+			}},
+		)
+	}
+
+	if *virtEnabled {
+		fields = append(fields,
+			nvidiaSmiField{"virtualization_mode", func(gpu *GPUInfo, value string) {
+				gpu.Passthrough = parsePassthrough(value)
+			}},
+		)
+	}
+
+	// gpustat only reports UUIDs in its JSON output
+	if *uuidLabel && !*gpustatJSONOutput {
+		fields = append(fields,
+			nvidiaSmiField{"uuid", func(gpu *GPUInfo, value string) {
+				if value != "[N/A]" {
+					gpu.UUID = value
+				}
+			}},
+		)
+	}
+
+	if *minorNumberLabel {
+		fields = append(fields,
+			nvidiaSmiField{"pci.bus_id", func(gpu *GPUInfo, value string) {
+				gpu.MinorNumber = readMinorNumber(value)
+			}},
+		)
+	}
+
+	return fields
+}
+
+// readMinorNumber looks up the device minor number of the GPU at the given
+// nvidia-smi PCI bus id (e.g. "00000000:3B:00.0") in the driver's procfs
+// entry, returning an empty string when unavailable
+func readMinorNumber(busID string) string {
+	// procfs uses a 4-digit lowercase domain, e.g. "0000:3b:00.0"
+	if len(busID) < 12 {
+		return ""
+	}
+	dir := strings.ToLower(busID[len(busID)-12:])
+
+	data, err := os.ReadFile(filepath.Join("/proc/driver/nvidia/gpus", dir, "information"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "Device Minor:"); ok {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// throttleReasonBits are the bits of nvidia-smi's clocks_throttle_reasons.active
+// bitmask, by the reason label they are exposed with
+var throttleReasonBits = []struct {
+	Reason string
+	Bit    uint64
+}{
+	{"gpu_idle", 0x1},
+	{"applications_clocks_setting", 0x2},
+	{"sw_power_cap", 0x4},
+	{"hw_slowdown", 0x8},
+	{"sync_boost", 0x10},
+	{"sw_thermal_slowdown", 0x20},
+	{"hw_thermal_slowdown", 0x40},
+	{"hw_power_brake_slowdown", 0x80},
+	{"display_clock_setting", 0x100},
+}
+
+// parseThrottleReasons decodes a throttle reason bitmask such as
+// "0x0000000000000044", or returns nil when the driver doesn't report it
+func parseThrottleReasons(value string) map[string]bool {
+	mask, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 64)
+	if err != nil {
+		return nil
+	}
+
+	reasons := make(map[string]bool, len(throttleReasonBits))
+	for _, r := range throttleReasonBits {
+		reasons[r.Reason] = mask&r.Bit != 0
+	}
+	return reasons
+}
+
+// parsePassthrough maps nvidia-smi's virtualization mode to 1 for a GPU passed
+// through to a VM and 0 otherwise, or nil when the driver doesn't report it
+func parsePassthrough(mode string) *float64 {
+	var passthrough float64
+	switch mode {
+	case "Pass-Through":
+		passthrough = 1
+	case "None", "VGPU", "Host VGPU", "Host VSGA":
+	default:
+		return nil
+	}
+	return &passthrough
+}
+
+// slowNvidiaSmiFields are the fields that rarely change and are only queried
+// every --scrape.slow-interval
+var slowNvidiaSmiFields = map[string]bool{
+	"power.default_limit":  true,
+	"power.enforced_limit": true,
+	"bar1.memory.total":    true,
+	"clocks.max.mem":       true,
+	"virtualization_mode":  true,
+	"pci.bus_id":           true,
+	"uuid":                 true,
+}
+
+// nvidiaSmiCache holds the result of the last nvidia-smi query
+type nvidiaSmiCache struct {
+	rows  map[string][]string
+	query string
+	at    time.Time
+}
+
+// get runs a single nvidia-smi query for all fields, retrying on failure and
+// reusing a result younger than ttl
+func (c *nvidiaSmiCache) get(ctx context.Context, fields []string, ttl time.Duration) (map[string][]string, error) {
+	query := strings.Join(fields, ",")
+	if c.rows != nil && c.query == query && time.Since(c.at) < ttl {
+		return c.rows, nil
+	}
+
+	var rows map[string][]string
+	var err error
+	for attempt := 0; attempt <= *nvidiaSmiRetries; attempt++ {
+		if rows, err = queryNvidiaSmi(ctx, fields...); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.rows = rows
+	c.query = query
+	c.at = time.Now()
+	return rows, nil
+}
+
+// mergeNvidiaSmi queries nvidia-smi for all fields required by enabled
+// features and merges the values into the GPUs by index
+func mergeNvidiaSmi(ctx context.Context, gpus []GPUInfo) error {
+	var fast, slow []nvidiaSmiField
+	for _, field := range nvidiaSmiFields() {
+		if *slowScrapeInterval > 0 && slowNvidiaSmiFields[field.Name] {
+			slow = append(slow, field)
+		} else {
+			fast = append(fast, field)
+		}
+	}
+
+	if err := applyNvidiaSmi(ctx, gpus, fast, &nvidiaSmiResults, *nvidiaSmiCacheTTL); err != nil {
+		setNvidiaSmiSuccess(0)
+		return err
+	}
+	if err := applyNvidiaSmi(ctx, gpus, slow, &nvidiaSmiSlowResults, *slowScrapeInterval); err != nil {
+		setNvidiaSmiSuccess(0)
+		return err
+	}
+	if *pcieThroughput {
+		if err := applyPCIeThroughput(ctx, gpus); err != nil {
+			setNvidiaSmiSuccess(0)
+			return err
+		}
+	}
+	if *collectProcessType {
+		if err := applyProcessTypes(ctx, gpus); err != nil {
+			setNvidiaSmiSuccess(0)
+			return err
+		}
+	}
+	if len(fast) > 0 || len(slow) > 0 || *pcieThroughput || *collectProcessType {
+		setNvidiaSmiSuccess(1)
+	}
+
+	return nil
+}
+
+// setNvidiaSmiSuccess records the outcome of the nvidia-smi augmentation
+func setNvidiaSmiSuccess(value float64) {
+	nvidiaSmiScrapeSuccess.Set(value)
+	augmentationSuccess.WithLabelValues("nvidia-smi").Set(value)
+}
+
+// applyNvidiaSmi queries the fields through the cache and merges the values
+// into the GPUs by index. A field the driver rejects is dropped and the query
+// retried, so one unsupported field doesn't lose all the others.
+func applyNvidiaSmi(ctx context.Context, gpus []GPUInfo, fields []nvidiaSmiField, cache *nvidiaSmiCache, ttl time.Duration) error {
+	var rows map[string][]string
+	for {
+		var supported []nvidiaSmiField
+		for _, field := range fields {
+			if !unsupportedNvidiaSmiFields[field.Name] {
+				supported = append(supported, field)
+			}
+		}
+		fields = supported
+		if len(fields) == 0 {
+			return nil
+		}
+
+		names := make([]string, len(fields))
+		for i, field := range fields {
+			names[i] = field.Name
+		}
+
+		var err error
+		rows, err = cache.get(ctx, names, ttl)
+		if err == nil {
+			break
+		}
+		match := invalidFieldRe.FindStringSubmatch(err.Error())
+		if match == nil || unsupportedNvidiaSmiFields[match[1]] || !slices.Contains(names, match[1]) {
+			return err
+		}
+		slog.Warn("nvidia-smi doesn't support query field, leaving it out", "field", match[1])
+		unsupportedNvidiaSmiFields[match[1]] = true
+	}
+
+	for i := range gpus {
+		values, ok := rows[gpus[i].Index]
+		if !ok {
+			continue
+		}
+		for j, field := range fields {
+			field.Apply(&gpus[i], values[j])
+		}
+	}
+
+	return nil
+}
+
+// applyPCIeThroughput samples PCIe throughput once with nvidia-smi dmon and
+// merges it into the GPUs by index. dmon waits for a full sampling interval,
+// so this adds about a second to the scrape.
+func applyPCIeThroughput(ctx context.Context, gpus []GPUInfo) error {
+	output, err := runNvidiaSmi(ctx, "dmon", "-s", "t", "-c", "1")
+	if err != nil {
+		return err
+	}
+
+	// Format: "# gpu   rxpci   txpci" header lines, then "    0      10      25"
+	rows := make(map[string][]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("unexpected nvidia-smi dmon row %q: expected 3 fields, got %d", line, len(fields))
+		}
+		rows[fields[0]] = fields[1:]
+	}
+
+	for i := range gpus {
+		values, ok := rows[gpus[i].Index]
+		if !ok {
+			continue
+		}
+		// dmon prints "-" for counters the GPU doesn't support
+		gpus[i].PCIeRx = parseOptionalFloat(values[0])
+		gpus[i].PCIeTx = parseOptionalFloat(values[1])
+	}
+	return nil
+}
+
+// computeProcess identifies a process running compute work on a GPU
+type computeProcess struct {
+	gpuUUID string
+	pid     string
+}
+
+// applyProcessTypes marks each process as compute or graphics. nvidia-smi only
+// lists compute processes, while gpustat reports both kinds, so a process
+// missing from the compute list of its GPU is a graphics one. A process using
+// both on the same GPU is reported as compute.
+func applyProcessTypes(ctx context.Context, gpus []GPUInfo) error {
+	output, err := runNvidiaSmi(ctx, "--query-compute-apps=gpu_uuid,pid", "--format=csv,noheader")
+	if err != nil {
+		return err
+	}
+
+	compute := make(map[computeProcess]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		uuid, pid, ok := strings.Cut(line, ",")
+		if !ok {
+			continue
+		}
+		compute[computeProcess{strings.TrimSpace(uuid), strings.TrimSpace(pid)}] = true
+	}
+
+	uuids, err := gpuUUIDs(ctx, gpus)
+	if err != nil {
+		return err
+	}
+	for i := range gpus {
+		for j := range gpus[i].Processes {
+			proc := &gpus[i].Processes[j]
+			if proc.PID == "" {
+				continue
+			}
+			if compute[computeProcess{uuids[i], proc.PID}] {
+				proc.ProcessType = "compute"
+			} else {
+				proc.ProcessType = "graphics"
+			}
+		}
+	}
+	return nil
+}
+
+// gpuUUIDs returns the UUID of each GPU, asking nvidia-smi for those gpustat
+// didn't report. The compute process list names GPUs only by UUID.
+func gpuUUIDs(ctx context.Context, gpus []GPUInfo) ([]string, error) {
+	uuids := make([]string, len(gpus))
+	missing := false
+	for i, gpu := range gpus {
+		uuids[i] = gpu.UUID
+		if gpu.UUID == "" {
+			missing = true
+		}
+	}
+	if !missing {
+		return uuids, nil
+	}
+
+	output, err := runNvidiaSmi(ctx, "--query-gpu=index,uuid", "--format=csv,noheader")
+	if err != nil {
+		return nil, err
+	}
+	byIndex := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if index, uuid, ok := strings.Cut(line, ","); ok {
+			byIndex[strings.TrimSpace(index)] = strings.TrimSpace(uuid)
+		}
+	}
+	for i, gpu := range gpus {
+		if uuids[i] == "" {
+			uuids[i] = byIndex[gpu.Index]
+		}
+	}
+	return uuids, nil
+}
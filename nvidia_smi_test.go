@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNvidiaSmi points --nvidia-smi.path at a shell script for the test
+func fakeNvidiaSmi(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake nvidia-smi is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "nvidia-smi")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatalf("failed to write fake nvidia-smi: %v", err)
+	}
+	setFlag(t, nvidiaSmiPath, path)
+}
+
+func TestMergeNvidiaSmiUnsupportedField(t *testing.T) {
+	// Drivers without virtualization_mode reject the whole query
+	fakeNvidiaSmi(t, `case "$1" in
+*virtualization_mode*)
+	echo 'Field "virtualization_mode" is not a valid field to query.'
+	exit 2
+	;;
+esac
+echo '0, 250.00, 300.00'
+`)
+	setFlag(t, powerLimits, true)
+	setFlag(t, virtEnabled, true)
+	t.Cleanup(func() {
+		unsupportedNvidiaSmiFields = make(map[string]bool)
+		nvidiaSmiResults = nvidiaSmiCache{}
+	})
+
+	gpus := []GPUInfo{{Index: "0"}}
+	if err := mergeNvidiaSmi(context.Background(), gpus); err != nil {
+		t.Fatalf("mergeNvidiaSmi() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(gpus[0].PowerDefaultLimit, floatPtr(250)) || !reflect.DeepEqual(gpus[0].PowerEnforcedLimit, floatPtr(300)) {
+		t.Errorf("power limits = %v, %v, want 250, 300", formatOptional(gpus[0].PowerDefaultLimit), formatOptional(gpus[0].PowerEnforcedLimit))
+	}
+	if gpus[0].Passthrough != nil {
+		t.Errorf("Passthrough = %v, want nil", *gpus[0].Passthrough)
+	}
+	if !unsupportedNvidiaSmiFields["virtualization_mode"] {
+		t.Error("virtualization_mode not marked as unsupported")
+	}
+}
+
+func TestMergeNvidiaSmiECC(t *testing.T) {
+	// Only the aggregate totals survive a driver reload, so only they are counters
+	fakeNvidiaSmi(t, `case "$1" in
+*ecc.errors.corrected.aggregate.total,ecc.errors.uncorrected.aggregate.total*)
+	echo '0, 12, 0'
+	echo '1, [N/A], [N/A]'
+	exit 0
+	;;
+esac
+exit 2
+`)
+	setFlag(t, collectECC, true)
+	t.Cleanup(func() { nvidiaSmiResults = nvidiaSmiCache{} })
+
+	gpus := []GPUInfo{{Index: "0"}, {Index: "1"}}
+	if err := mergeNvidiaSmi(context.Background(), gpus); err != nil {
+		t.Fatalf("mergeNvidiaSmi() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(gpus[0].ECCCorrected, floatPtr(12)) || !reflect.DeepEqual(gpus[0].ECCUncorrected, floatPtr(0)) {
+		t.Errorf("GPU 0 ECC errors = %v, %v, want 12, 0", formatOptional(gpus[0].ECCCorrected), formatOptional(gpus[0].ECCUncorrected))
+	}
+	if gpus[1].ECCCorrected != nil || gpus[1].ECCUncorrected != nil {
+		t.Errorf("GPU 1 ECC errors = %v, %v, want none", formatOptional(gpus[1].ECCCorrected), formatOptional(gpus[1].ECCUncorrected))
+	}
+}
+
+func TestApplyProcessTypes(t *testing.T) {
+	fakeNvidiaSmi(t, `case "$1" in
+--query-compute-apps=*)
+	echo 'GPU-aaaa, 1234'
+	echo 'GPU-bbbb, 5678'
+	;;
+--query-gpu=index,uuid)
+	echo '0, GPU-aaaa'
+	echo '1, GPU-bbbb'
+	;;
+esac
+`)
+
+	// alice renders on GPU 1 from the process computing on GPU 0
+	gpus := []GPUInfo{
+		{Index: "0", Processes: []ProcessInfo{
+			{Username: "alice", Command: "python", PID: "1234"},
+			{Username: "root", Command: "Xorg", PID: "900"},
+			{Username: "bob"},
+		}},
+		{Index: "1", UUID: "GPU-bbbb", Processes: []ProcessInfo{
+			{Username: "alice", Command: "python", PID: "1234"},
+			{Username: "carol", Command: "python", PID: "5678"},
+		}},
+	}
+	if err := applyProcessTypes(context.Background(), gpus); err != nil {
+		t.Fatalf("applyProcessTypes() error = %v", err)
+	}
+
+	want := [][]string{{"compute", "graphics", "unknown"}, {"graphics", "compute"}}
+	for i, gpu := range gpus {
+		for j, proc := range gpu.Processes {
+			if got := processTypeLabel(proc); got != want[i][j] {
+				t.Errorf("GPU %s process %s type = %q, want %q", gpu.Index, proc.Username, got, want[i][j])
+			}
+		}
+	}
+}
+
+// TestCollectMetricsAugmentationFailure checks that a failing nvidia-smi only
+// loses the extra metrics while the core gpustat metrics are still served
+func TestCollectMetricsAugmentationFailure(t *testing.T) {
+	fixture, err := filepath.Abs(filepath.Join("testdata", "dgx.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		nvidiaSmi        string
+		wantAugmentation float64
+		wantPowerLimit   []float64
+	}{
+		{"success", "echo '0, 250.00, 300.00'", 1, []float64{300}},
+		{"failure", "echo 'Failed to initialize NVML: Driver/library version mismatch'\nexit 9", 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(initMetrics)
+			t.Cleanup(func() { nvidiaSmiResults = nvidiaSmiCache{} })
+			fakeGPUStat(t, "cat '"+fixture+"'\n")
+			fakeNvidiaSmi(t, tt.nvidiaSmi+"\n")
+			setFlag(t, powerLimits, true)
+			initMetrics()
+
+			if err := collectMetrics(); err != nil {
+				t.Fatalf("collectMetrics() error = %v", err)
+			}
+
+			if got := seriesValues(t, augmentationSuccess, map[string]string{"source": "nvidia-smi"}); !equalFloats(got, []float64{tt.wantAugmentation}) {
+				t.Errorf("augmentation_success = %v, want [%v]", got, tt.wantAugmentation)
+			}
+			if got := seriesValues(t, scrapeSuccess, nil); !equalFloats(got, []float64{1}) {
+				t.Errorf("scrape_success = %v, want [1]", got)
+			}
+			if got := seriesValues(t, gpuTemperature, map[string]string{"hostname": "dgx-node-01"}); len(got) != 8 {
+				t.Errorf("collected %d temperature series, want 8", len(got))
+			}
+			if got := seriesValues(t, gpuPowerEnforcedLimit, map[string]string{"gpu_index": "0"}); !equalFloats(got, tt.wantPowerLimit) {
+				t.Errorf("enforced power limit = %v, want %v", got, tt.wantPowerLimit)
+			}
+		})
+	}
+}
+
+func TestRunNvidiaSmiTimeout(t *testing.T) {
+	// A wedged driver blocks nvidia-smi like it blocks gpustat. The sleep
+	// child keeps stdout open after the shell is killed.
+	fakeNvidiaSmi(t, "sleep 10\n")
+	setFlag(t, gpustatTimeout, 100*time.Millisecond)
+
+	start := time.Now()
+	_, err := runNvidiaSmi(context.Background(), "--query-gpu=index", "--format=csv,noheader")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("runNvidiaSmi() error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("runNvidiaSmi() returned after %s, want it killed at the timeout", elapsed)
+	}
+}
+
+func TestThrottleSeconds(t *testing.T) {
+	setFlag(t, scrapeInterval, 15*time.Second)
+	t.Cleanup(func() { throttleSamples = make(map[string]throttleSample) })
+	gpuThrottleSeconds.Reset()
+
+	stats := &GPUStatOutput{Hostname: "gpu-node-01"}
+	gpu := GPUInfo{
+		Index:           "0",
+		Name:            "NVIDIA A100-SXM4-80GB",
+		ThrottleReasons: map[string]bool{"sw_power_cap": true, "gpu_idle": false},
+	}
+	reasonSeconds := func(reason string) []float64 {
+		return seriesValues(t, gpuThrottleSeconds, map[string]string{"hostname": "gpu-node-01", "reason": reason})
+	}
+
+	// The first sample has no previous one to measure from
+	updateGPUMetrics(stats, gpu)
+	if got := reasonSeconds("sw_power_cap"); !equalFloats(got, []float64{0}) {
+		t.Fatalf("first sw_power_cap seconds = %v, want [0]", got)
+	}
+
+	key := memoryHistoryKey(stats, gpu)
+	for _, gap := range []time.Duration{15 * time.Second, time.Hour} {
+		sample := throttleSamples[key]
+		sample.at = time.Now().Add(-gap)
+		throttleSamples[key] = sample
+		updateGPUMetrics(stats, gpu)
+	}
+	// Only the 15s gap counts, the hour is longer than two scrape intervals
+	if got := reasonSeconds("sw_power_cap"); len(got) != 1 || got[0] < 15 || got[0] > 16 {
+		t.Errorf("sw_power_cap seconds = %v, want about 15", got)
+	}
+	if got := reasonSeconds("gpu_idle"); !equalFloats(got, []float64{0}) {
+		t.Errorf("gpu_idle seconds = %v, want [0]", got)
+	}
+
+	// A GPU that's gone loses its series
+	pruneThrottleSamples(nil)
+	if got := reasonSeconds("sw_power_cap"); len(got) != 0 {
+		t.Errorf("sw_power_cap seconds after pruning = %v, want none", got)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// unassignedTeam is the team label of GPUs missing from the ownership file
+const unassignedTeam = "unassigned"
+
+// ownership maps GPU UUIDs and indexes to teams, nil when --ownership.file is unset
+var (
+	ownershipMu sync.RWMutex
+	ownership   map[string]string
+)
+
+// loadOwnership reads the ownership file, one "<gpu_index or uuid>=<team>" pair
+// per line; blank lines and lines starting with # are ignored
+func loadOwnership(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	teams := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, team, ok := strings.Cut(text, "=")
+		key, team = strings.TrimSpace(key), strings.TrimSpace(team)
+		if !ok || key == "" || team == "" {
+			return nil, fmt.Errorf("%s:%d: invalid mapping %q, expected <gpu_index or uuid>=<team>", file, line, text)
+		}
+		teams[key] = team
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return teams, nil
+}
+
+// setupOwnership loads the ownership file and reloads it on SIGHUP, keeping the
+// previous mapping if the file becomes invalid
+func setupOwnership(file string) error {
+	teams, err := loadOwnership(file)
+	if err != nil {
+		return err
+	}
+	ownership = teams
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGHUP)
+		for range sigs {
+			teams, err := loadOwnership(file)
+			if err != nil {
+				slog.Error("Error reloading ownership file", "err", err)
+				continue
+			}
+
+			ownershipMu.Lock()
+			ownership = teams
+			ownershipMu.Unlock()
+			slog.Info("Reloaded ownership file", "path", file, "gpus", len(teams))
+		}
+	}()
+
+	return nil
+}
+
+// gpuTeam returns the team owning a GPU, matched by UUID before index
+func gpuTeam(gpu GPUInfo) string {
+	ownershipMu.RLock()
+	defer ownershipMu.RUnlock()
+
+	if team, ok := ownership[gpu.UUID]; ok && gpu.UUID != "" {
+		return team
+	}
+	if team, ok := ownership[gpu.Index]; ok {
+		return team
+	}
+	return unassignedTeam
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pusher pushes collected metrics to a Pushgateway, nil when disabled
+var pusher *push.Pusher
+
+// parseGrouping parses comma-separated key=value pairs into a grouping key,
+// defaulting to instance=<hostname> when empty
+func parseGrouping(grouping string) (map[string]string, error) {
+	result := make(map[string]string)
+
+	if strings.TrimSpace(grouping) == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine hostname for default grouping: %w", err)
+		}
+		result["instance"] = hostname
+		return result, nil
+	}
+
+	for _, pair := range strings.Split(grouping, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid grouping pair %q, expected key=value", pair)
+		}
+		result[key] = value
+	}
+
+	return result, nil
+}
+
+// setupPushgateway configures the pusher
+func setupPushgateway() error {
+	grouping, err := parseGrouping(*pushgatewayGrouping)
+	if err != nil {
+		return err
+	}
+
+	pusher = push.New(*pushgatewayURL, *pushgatewayJob).Gatherer(prometheus.DefaultGatherer)
+	for key, value := range grouping {
+		pusher = pusher.Grouping(key, value)
+	}
+
+	return nil
+}
+
+// pushMetrics pushes the current metrics to the Pushgateway if enabled
+func pushMetrics() {
+	if pusher == nil {
+		return
+	}
+	if err := pusher.Push(); err != nil {
+		slog.Error("Error pushing metrics to Pushgateway", "err", err)
+	}
+}
+
+// deletePushgateway deletes our group from the Pushgateway if enabled, so stale
+// metrics don't linger there after shutdown
+func deletePushgateway() {
+	if pusher == nil {
+		return
+	}
+	if err := pusher.Delete(); err != nil {
+		slog.Error("Error deleting metrics from Pushgateway", "err", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rocmSmiArgs are the rocm-smi options queried with --backend=rocm-smi. The
+// product name and VRAM usage in bytes are needed for gpu_name and the
+// memory gauges; --showmemuse alone only reports percentages.
+var rocmSmiArgs = []string{"--showtemp", "--showuse", "--showmemuse", "--showproductname", "--showmeminfo", "vram", "--json"}
+
+// rocmCardRe matches the per-GPU keys of rocm-smi's JSON output, e.g. "card0"
+var rocmCardRe = regexp.MustCompile(`^card(\d+)$`)
+
+// parseRocmSmiJSON parses "rocm-smi --json" output into the same structure as
+// gpustat's, so AMD GPUs produce the same metrics. rocm-smi carries no
+// hostname or process list, so the local hostname is used and no per-user
+// metrics are produced.
+func parseRocmSmiJSON(output string) ([]*GPUStatOutput, error) {
+	// Some rocm-smi versions print warnings before the JSON document
+	if i := strings.Index(output, "{"); i > 0 {
+		output = output[i:]
+	}
+
+	var cards map[string]map[string]any
+	if err := json.Unmarshal([]byte(output), &cards); err != nil {
+		return nil, fmt.Errorf("invalid rocm-smi JSON output: %w", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine hostname for rocm-smi output: %w", err)
+	}
+	result := &GPUStatOutput{Hostname: hostname}
+
+	for key, card := range cards {
+		match := rocmCardRe.FindStringSubmatch(key)
+		if match == nil {
+			// e.g. the "system" section
+			continue
+		}
+
+		gpu := GPUInfo{
+			Index: match[1],
+			Name:  rocmValue(card, "Card Series", "Card series", "Card model"),
+		}
+		gpu.Temperature = parseOptionalFloat(rocmValue(card, "Temperature (Sensor edge) (C)", "Temperature (Sensor junction) (C)"))
+		gpu.Utilization = parseOptionalFloat(rocmValue(card, "GPU use (%)"))
+
+		// Reported in bytes; gpustat's megabytes are MiB
+		used, usedErr := strconv.ParseFloat(rocmValue(card, "VRAM Total Used Memory (B)"), 64)
+		total, totalErr := strconv.ParseFloat(rocmValue(card, "VRAM Total Memory (B)"), 64)
+		if usedErr == nil && totalErr == nil {
+			used, total = used/(1024*1024), total/(1024*1024)
+			gpu.MemoryUsed, gpu.MemoryTotal = &used, &total
+		} else {
+			result.zeroValued = append(result.zeroValued, "memory")
+		}
+
+		result.GPUs = append(result.GPUs, gpu)
+	}
+
+	// Map order is random, so sort by card number
+	sort.Slice(result.GPUs, func(i, j int) bool {
+		a, _ := strconv.Atoi(result.GPUs[i].Index)
+		b, _ := strconv.Atoi(result.GPUs[j].Index)
+		return a < b
+	})
+
+	return []*GPUStatOutput{result}, nil
+}
+
+// rocmValue returns the first of the given fields present on a card, as rocm-smi
+// has renamed some of them between versions
+func rocmValue(card map[string]any, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := card[key]; ok {
+			return strings.TrimSpace(fmt.Sprint(value))
+		}
+	}
+	return ""
+}
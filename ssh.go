@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// sshTarget is an entry of --gpustat.ssh-hosts: a user@host target and how
+// often to scrape it, 0 for every scrape
+type sshTarget struct {
+	address  string
+	interval time.Duration
+}
+
+// sshHostResult is the last successful scrape of an SSH target
+type sshHostResult struct {
+	at    time.Time
+	hosts []*GPUStatOutput
+}
+
+// Last successful scrape of each SSH target, reused until the target's
+// interval has passed. Only collectSSHHosts touches it.
+var sshHostResults = make(map[string]sshHostResult)
+
+// parseSSHTargets parses --gpustat.ssh-hosts, a comma-separated list of
+// user@host targets each optionally followed by "=<interval>"
+func parseSSHTargets(spec string) ([]sshTarget, error) {
+	var targets []sshTarget
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		address, value, hasInterval := strings.Cut(entry, "=")
+		target := sshTarget{address: strings.TrimSpace(address)}
+		// ssh would take such a target for one of its options
+		if target.address == "" || strings.HasPrefix(target.address, "-") {
+			return nil, fmt.Errorf("invalid target %q", target.address)
+		}
+		if hasInterval {
+			interval, err := time.ParseDuration(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid interval for %s: %w", target.address, err)
+			}
+			if interval < *scrapeInterval {
+				return nil, fmt.Errorf("interval %s for %s is shorter than --scrape.interval %s", interval, target.address, *scrapeInterval)
+			}
+			target.interval = interval
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// sshTargets returns the targets listed in --gpustat.ssh-hosts, which main
+// has already validated
+func sshTargets() []sshTarget {
+	targets, _ := parseSSHTargets(*sshHosts)
+	return targets
+}
+
+// collectSSHHosts runs gpustat on every SSH target whose interval has passed,
+// at most --gpustat.ssh-concurrency at a time, and reuses the last result of
+// the others. A host that fails is logged and skipped; the scrape only fails
+// when no host has a result.
+func collectSSHHosts(ctx context.Context) ([]*GPUStatOutput, error) {
+	targets := sshTargets()
+	results := make([][]*GPUStatOutput, len(targets))
+	ran := make([]bool, len(targets))
+	failed := make([]bool, len(targets))
+
+	now := time.Now()
+	slots := make(chan struct{}, *sshConcurrency)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		// Allow half a scrape interval of ticker jitter, so a host isn't
+		// held back until the scrape after the one it was due in
+		if last, ok := sshHostResults[target.address]; ok && now.Sub(last.at) < target.interval-*scrapeInterval/2 {
+			results[i] = last.hosts
+			continue
+		}
+
+		ran[i] = true
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			workersActive.Inc()
+			defer func() {
+				workersActive.Dec()
+				<-slots
+			}()
+
+			hosts, err := runSSH(ctx, target)
+			if err != nil {
+				slog.Warn("Failed to scrape SSH host", "target", target, "err", err)
+				failed[i] = true
+				hostScrapeSuccess.WithLabelValues(target).Set(0)
+				return
+			}
+			results[i] = hosts
+			hostScrapeSuccess.WithLabelValues(target).Set(1)
+		}(i, target.address)
+	}
+	wg.Wait()
+
+	// Remember fresh results; a failed host is retried on the next scrape
+	// rather than serving its old result
+	for i, target := range targets {
+		if failed[i] {
+			delete(sshHostResults, target.address)
+		} else if ran[i] {
+			sshHostResults[target.address] = sshHostResult{at: now, hosts: results[i]}
+		}
+	}
+
+	// Keep the order of --gpustat.ssh-hosts regardless of which host answered first
+	var hosts []*GPUStatOutput
+	for _, result := range results {
+		hosts = append(hosts, result...)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("failed to scrape any of the %d SSH hosts", len(targets))
+	}
+	return hosts, nil
+}
+
+// sshCommand returns the command line that runs gpustat on an SSH target.
+// BatchMode fails instead of hanging on a password or host key prompt.
+func sshCommand(target string) []string {
+	command := []string{"ssh", "-o", "BatchMode=yes"}
+	if *sshKnownHosts != "" {
+		command = append(command, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+*sshKnownHosts)
+	}
+	if *sshAgentSocket != "" {
+		command = append(command, "-o", "IdentityAgent="+*sshAgentSocket)
+	}
+	// End the options so a target can never be read as one
+	command = append(command, "--", target)
+	return append(command, gpustatCommand()...)
+}
+
+// runSSH runs and parses gpustat on a single SSH target
+func runSSH(ctx context.Context, target string) ([]*GPUStatOutput, error) {
+	ctx, span := tracer.Start(ctx, "ssh")
+	defer span.End()
+	span.SetAttributes(attribute.String("target", target))
+
+	start := time.Now()
+	command := sshCommand(target)
+	output, err := execGPUStat(ctx, command[0], command[1:]...)
+	execDuration.WithLabelValues(target).Set(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute gpustat on %s: %w", target, err)
+	}
+	outputBytes.WithLabelValues(target, "").Set(float64(len(output)))
+	span.SetAttributes(attribute.Int("output_bytes", len(output)))
+
+	hosts, err := gpustatParser()(string(output))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse gpustat output from %s: %w", target, err)
+	}
+
+	// CSV, rocm-smi and headerless output have no hostname, so use the SSH
+	// host rather than our own
+	_, host, ok := strings.Cut(target, "@")
+	if !ok {
+		host = target
+	}
+	for _, stats := range hosts {
+		if *gpustatFormat == "csv" || *backend == "rocm-smi" || stats.noHeader {
+			stats.Hostname = host
+		}
+	}
+	return hosts, nil
+}
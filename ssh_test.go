@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSHCommand(t *testing.T) {
+	setFlag(t, gpustatPath, "gpustat")
+	setFlag(t, backend, "gpustat")
+
+	tests := []struct {
+		name        string
+		knownHosts  string
+		agentSocket string
+		want        []string
+	}{
+		{"default", "", "", []string{"ssh", "-o", "BatchMode=yes", "--", "monitor@gpu-node-01", "gpustat"}},
+		{"known hosts", "/etc/gpustat-exporter/known_hosts", "", []string{
+			"ssh", "-o", "BatchMode=yes",
+			"-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile=/etc/gpustat-exporter/known_hosts",
+			"--", "monitor@gpu-node-01", "gpustat",
+		}},
+		{"agent", "", "/run/gpustat-exporter/agent.sock", []string{
+			"ssh", "-o", "BatchMode=yes",
+			"-o", "IdentityAgent=/run/gpustat-exporter/agent.sock",
+			"--", "monitor@gpu-node-01", "gpustat",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, sshKnownHosts, tt.knownHosts)
+			setFlag(t, sshAgentSocket, tt.agentSocket)
+			if got := sshCommand("monitor@gpu-node-01"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sshCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSSHTargets(t *testing.T) {
+	setFlag(t, scrapeInterval, 30*time.Second)
+
+	tests := []struct {
+		spec    string
+		want    []sshTarget
+		wantErr bool
+	}{
+		{"monitor@gpu-node-01", []sshTarget{{"monitor@gpu-node-01", 0}}, false},
+		{" monitor@a , monitor@b=5m ,", []sshTarget{{"monitor@a", 0}, {"monitor@b", 5 * time.Minute}}, false},
+		{"monitor@a=30s", []sshTarget{{"monitor@a", 30 * time.Second}}, false},
+		{"monitor@a=10s", nil, true},
+		{"monitor@a=often", nil, true},
+		{"-oProxyCommand=touch /tmp/pwned", nil, true},
+		{"=5m", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseSSHTargets(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSSHTargets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSSHTargets() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeSSH puts an ssh script on PATH that prints gpustat output named after
+// the target's host and records each run in the returned directory. The
+// host "down" can't be reached and "bare" prints no header.
+func fakeSSH(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ssh is a shell script")
+	}
+	dir := t.TempDir()
+	script := `#!/bin/sh
+for arg; do
+	case "$arg" in
+	*@*) host=${arg#*@} ;;
+	esac
+done
+echo run >> "` + dir + `/runs-$host"
+if [ "$host" = down ]; then
+	echo "ssh: connect to host down port 22: Connection refused" >&2
+	exit 255
+fi
+[ "$host" = bare ] || echo "$host                  Wed Oct 15 12:00:00 2025  535.104.05"
+echo "[0] NVIDIA A100-SXM4-80GB | 45°C,  90 % |  1000 / 81920 MB |"
+`
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write fake ssh: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return dir
+}
+
+func TestCollectSSHHostsIntervals(t *testing.T) {
+	dir := fakeSSH(t)
+	setFlag(t, scrapeInterval, 30*time.Second)
+	setFlag(t, sshHosts, "monitor@fast,monitor@slow=1h,monitor@down")
+	t.Cleanup(func() { sshHostResults = make(map[string]sshHostResult) })
+
+	for scrape := 0; scrape < 2; scrape++ {
+		hosts, err := collectSSHHosts(context.Background())
+		if err != nil {
+			t.Fatalf("collectSSHHosts() error = %v", err)
+		}
+		var hostnames []string
+		for _, stats := range hosts {
+			hostnames = append(hostnames, stats.Hostname)
+		}
+		// The slow host's last output is served between its runs
+		if want := []string{"fast", "slow"}; !reflect.DeepEqual(hostnames, want) {
+			t.Errorf("scrape %d hostnames = %q, want %q", scrape, hostnames, want)
+		}
+	}
+
+	for host, want := range map[string]int{"fast": 2, "slow": 1, "down": 2} {
+		data, _ := os.ReadFile(filepath.Join(dir, "runs-"+host))
+		if got := strings.Count(string(data), "run"); got != want {
+			t.Errorf("%s ran %d times, want %d", host, got, want)
+		}
+	}
+	for host, want := range map[string]float64{"monitor@fast": 1, "monitor@slow": 1, "monitor@down": 0} {
+		if got := seriesValues(t, hostScrapeSuccess, map[string]string{"host": host}); !equalFloats(got, []float64{want}) {
+			t.Errorf("%s host_scrape_success = %v, want [%v]", host, got, want)
+		}
+	}
+}
+
+func TestRunSSHNoHeader(t *testing.T) {
+	fakeSSH(t)
+
+	hosts, err := runSSH(context.Background(), "monitor@bare")
+	if err != nil {
+		t.Fatalf("runSSH() error = %v", err)
+	}
+	if len(hosts) != 1 || hosts[0].Hostname != "bare" {
+		t.Fatalf("runSSH() = %+v, want one host named after the target", hosts)
+	}
+
+	if got := seriesValues(t, outputBytes, map[string]string{"host": "monitor@bare"}); len(got) != 1 || got[0] == 0 {
+		t.Errorf("output_bytes = %v, want the output size", got)
+	}
+	if got := seriesValues(t, execDuration, map[string]string{"host": "monitor@bare"}); len(got) != 1 {
+		t.Errorf("exec_duration_seconds = %v, want one series", got)
+	}
+}
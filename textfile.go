@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// exporterGatherer gathers only the exporter's own metrics, leaving out the Go
+// runtime and process metrics that node_exporter already exposes and would
+// reject as duplicates in a textfile
+var exporterGatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+
+	filtered := families[:0]
+	for _, family := range families {
+		name := family.GetName()
+		if strings.HasPrefix(name, *metricNamespace+"_") || strings.HasPrefix(name, *driverInfoNamespace+"_") {
+			filtered = append(filtered, family)
+		}
+	}
+	return filtered, err
+})
+
+// writeTextfile writes the current metrics for node_exporter's textfile
+// collector if enabled. The file is written to a temporary file and renamed,
+// so the collector never reads a partial scrape.
+func writeTextfile() {
+	if *textfileOutput == "" {
+		return
+	}
+
+	if err := prometheus.WriteToTextfile(*textfileOutput, exporterGatherer); err != nil {
+		slog.Error("Error writing metrics to textfile", "path", *textfileOutput, "err", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// validationChecks are the sanity checks run by --validate.enabled
+var validationChecks = []string{"user_memory", "utilization_range"}
+
+// validationKey identifies a GPU in the gathered metrics
+type validationKey struct {
+	hostname  string
+	gpuIndex  string
+	namespace string
+}
+
+// validateMetrics reads back the metrics built by this scrape and checks them
+// against each other and the parsed GPUs, logging and counting violations.
+// It never changes the emitted metrics.
+func validateMetrics(gatherer prometheus.Gatherer, hosts []*GPUStatOutput) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	var (
+		memoryUsed  = make(map[validationKey]float64)
+		userMemory  = make(map[validationKey]float64)
+		utilization = make(map[validationKey]float64)
+	)
+	for _, family := range families {
+		var values map[validationKey]float64
+		switch family.GetName() {
+		case *metricNamespace + "_memory_used_megabytes":
+			values = memoryUsed
+		case *metricNamespace + "_user_memory_megabytes":
+			values = userMemory
+		case *metricNamespace + "_utilization_percent":
+			values = utilization
+		default:
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			var key validationKey
+			for _, label := range metric.GetLabel() {
+				switch label.GetName() {
+				case "hostname":
+					key.hostname = label.GetValue()
+				case "gpu_index":
+					key.gpuIndex = label.GetValue()
+				case "namespace":
+					key.namespace = label.GetValue()
+				}
+			}
+			// Per-user series are summed per GPU
+			values[key] += metric.GetGauge().GetValue()
+		}
+	}
+
+	for _, stats := range hosts {
+		for _, gpu := range stats.GPUs {
+			key := validationKey{stats.Hostname, gpu.Index, gpu.Namespace}
+			used, ok := memoryUsed[key]
+			if !ok {
+				// Skipped, e.g. by --metrics.only-active-gpus
+				continue
+			}
+
+			if userMemory[key] > used+*validateMemoryTolerance {
+				validationFailed("user_memory", key, fmt.Sprintf("per-user memory %.0f MB exceeds used memory %.0f MB", userMemory[key], used))
+			}
+			if value := utilization[key]; value < 0 || value > 100 {
+				validationFailed("utilization_range", key, fmt.Sprintf("utilization %g%% out of range", value))
+			}
+		}
+	}
+
+	return nil
+}
+
+// validationFailed logs and counts a failed check
+func validationFailed(check string, key validationKey, detail string) {
+	slog.Warn("Validation check failed", "check", check, "hostname", key.hostname, "gpu_index", key.gpuIndex, "detail", detail)
+	validationFailures.WithLabelValues(check).Inc()
+}